@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	envAPIRoot    = "FUZZYMONKEY_API_ROOT"
+	envCAFile     = "FUZZYMONKEY_CA_FILE"
+	envClientCert = "FUZZYMONKEY_CLIENT_CERT"
+	envClientKey  = "FUZZYMONKEY_CLIENT_KEY"
+)
+
+// setAPIRoot points every FuzzyMonkey endpoint at the given root,
+// linting included.
+func setAPIRoot(root string) {
+	apiRoot = strings.TrimSuffix(root, "/")
+	initURL = apiRoot + "/init"
+	nextURL = apiRoot + "/next"
+	streamURL = apiRoot + "/stream"
+	lintURL = apiRoot + "/blob"
+	log.Printf("[NFO] using API root %s\n", apiRoot)
+}
+
+// maybeSetAPIRoot applies the --api-root flag, else $FUZZYMONKEY_API_ROOT.
+func maybeSetAPIRoot(flag interface{}) {
+	if root, ok := flag.(string); ok && root != "" {
+		setAPIRoot(root)
+		return
+	}
+	if root := os.Getenv(envAPIRoot); root != "" {
+		setAPIRoot(root)
+	}
+}
+
+// newClientUtils builds the client used to talk to FuzzyMonkey,
+// trusting an extra CA bundle and presenting a client certificate
+// when the environment asks for them.
+func newClientUtils() (client *http.Client, err error) {
+	client = &http.Client{}
+	caFile := os.Getenv(envCAFile)
+	certFile := os.Getenv(envClientCert)
+	keyFile := os.Getenv(envClientKey)
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return
+	}
+
+	tlsConfig, err := newTLSConfig(caFile, certFile, keyFile)
+	if err != nil {
+		return
+	}
+
+	// Same as http.DefaultTransport's but for TLS
+	client.Transport = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+	return
+}
+
+// newTLSConfig trusts the system's CAs plus those of caFile, if any,
+// and presents the client certificate certFile & keyFile, if any.
+func newTLSConfig(caFile, certFile, keyFile string) (tlsConfig *tls.Config, err error) {
+	tlsConfig = &tls.Config{}
+
+	if caFile != "" {
+		var pem []byte
+		if pem, err = ioutil.ReadFile(caFile); err != nil {
+			log.Println("[ERR]", err)
+			fmt.Printf("Could not read CA bundle '%s'\n", caFile)
+			return
+		}
+
+		pool, poolErr := x509.SystemCertPool()
+		if poolErr != nil {
+			log.Println("[NFO]", poolErr)
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			err = fmt.Errorf("no PEM certificates found in %s", caFile)
+			log.Println("[ERR]", err)
+			fmt.Println(err)
+			return
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			log.Println("[ERR]", err)
+			fmt.Printf("Could not load client certificate '%s' with key '%s'\n",
+				certFile, keyFile)
+			return
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// assertionYML is checked against the responses to the requests it scopes.
+// Any failed check makes the test fail.
+type assertionYML struct {
+	// Method, when set, scopes the assertion to requests of this method
+	Method string `yaml:"method"`
+	// Path, when set, scopes the assertion to requests with a matching path.
+	// It is a pattern as understood by path.Match, so * matches one segment.
+	Path string `yaml:"path"`
+	// Status lists the allowed status codes
+	Status []int `yaml:"status"`
+	// MaxLatency is a duration such as 250ms that responses should take less than
+	MaxLatency string `yaml:"max_latency"`
+	maxLatency time.Duration
+	// Headers maps a header to its expected value.
+	// A value of * only checks the header is present and
+	// a value ending with * checks the header starts with it.
+	Headers map[string]string `yaml:"headers"`
+	// JSON checks the response body
+	JSON []*jsonAssertionYML `yaml:"json"`
+}
+
+type jsonAssertionYML struct {
+	// Path is a JSONPath such as $.items[0].id or $['some key']
+	Path   string      `yaml:"path"`
+	Equals interface{} `yaml:"equals"`
+	Exists *bool       `yaml:"exists"`
+	steps  []jsonPathStep
+	equals interface{}
+}
+
+type jsonPathStep struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// compileAssertions checks assertions & compiles what it can, once
+func compileAssertions(assertions []*assertionYML) (err error) {
+	for i, assertion := range assertions {
+		if _, err = path.Match(assertion.Path, "/"); err != nil {
+			err = fmt.Errorf("assertion #%d: bad path pattern %q", i+1, assertion.Path)
+			break
+		}
+		if assertion.MaxLatency != "" {
+			if assertion.maxLatency, err = time.ParseDuration(assertion.MaxLatency); err != nil {
+				err = fmt.Errorf("assertion #%d: bad max_latency %q", i+1, assertion.MaxLatency)
+				break
+			}
+		}
+		for _, check := range assertion.JSON {
+			if check.steps, err = parseJSONPath(check.Path); err != nil {
+				err = fmt.Errorf("assertion #%d: %s", i+1, err)
+				break
+			}
+			if check.Equals != nil {
+				if check.equals, err = asJSON(check.Equals); err != nil {
+					err = fmt.Errorf("assertion #%d: %s", i+1, err)
+					break
+				}
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		log.Println("[ERR]", err)
+		fmt.Println(err)
+	}
+	return
+}
+
+// assertionsFor lists the assertions that apply to a request
+func (cfg *ymlCfg) assertionsFor(method, URL string) (assertions []*assertionYML) {
+	if len(cfg.Assertions) == 0 {
+		return
+	}
+
+	reqPath := URL
+	if u, err := url.Parse(URL); err == nil {
+		reqPath = u.Path
+	}
+	for _, assertion := range cfg.Assertions {
+		if assertion.Method != "" && !strings.EqualFold(assertion.Method, method) {
+			continue
+		}
+		if assertion.Path != "" {
+			if ok, _ := path.Match(assertion.Path, reqPath); !ok {
+				continue
+			}
+		}
+		assertions = append(assertions, assertion)
+	}
+	return
+}
+
+// violations lists how a response, that took us microseconds, fails the assertions
+func violations(assertions []*assertionYML, resp *http.Response, us uint64) (found []string) {
+	if len(assertions) == 0 {
+		return
+	}
+
+	var doc interface{}
+	var docErr error
+	var docRead bool
+	for _, assertion := range assertions {
+		if len(assertion.Status) != 0 && !containsInt(assertion.Status, resp.StatusCode) {
+			found = append(found, fmt.Sprintf("status %d is not one of %v",
+				resp.StatusCode, assertion.Status))
+		}
+
+		if took := time.Duration(us) * time.Microsecond; assertion.maxLatency != 0 && took > assertion.maxLatency {
+			found = append(found, fmt.Sprintf("latency %s exceeds %s", took, assertion.maxLatency))
+		}
+
+		names := make([]string, 0, len(assertion.Headers))
+		for name := range assertion.Headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if expected := assertion.Headers[name]; !headerMatches(resp.Header, name, expected) {
+				found = append(found, fmt.Sprintf("header %s: got %q, expected %q",
+					name, resp.Header.Get(name), expected))
+			}
+		}
+
+		if len(assertion.JSON) != 0 && !docRead {
+			docRead = true
+			var body []byte
+			if body, docErr = ioutil.ReadAll(resp.Body); docErr == nil {
+				docErr = json.Unmarshal(body, &doc)
+			}
+		}
+		for _, check := range assertion.JSON {
+			if docErr != nil {
+				found = append(found, fmt.Sprintf("%s: body is not JSON", check.Path))
+				continue
+			}
+			if violation := check.violation(doc); violation != "" {
+				found = append(found, violation)
+			}
+		}
+	}
+
+	if len(found) != 0 {
+		log.Printf("[NFO] assertions failed: %q\n", found)
+	}
+	return
+}
+
+// warnIfAssertionsIgnored tells when failing assertions cannot fail tests:
+// servers only get told of violations from protocol v2 on.
+func warnIfAssertionsIgnored(cfg *ymlCfg) {
+	if protocolV != 1 || len(cfg.Assertions) == 0 {
+		return
+	}
+	log.Println("[NFO] assertions are not reported over protocol v1")
+	fmt.Println("Assertions & latency budgets will not fail tests: the server only speaks protocol v1")
+}
+
+// needsBody tells whether checking the assertions requires the response body
+func needsBody(assertions []*assertionYML) bool {
+	for _, assertion := range assertions {
+		if len(assertion.JSON) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func headerMatches(header http.Header, name, expected string) bool {
+	got := header.Get(name)
+	switch {
+	case expected == "*":
+		return len(header[http.CanonicalHeaderKey(name)]) != 0
+	case strings.HasSuffix(expected, "*"):
+		return strings.HasPrefix(got, strings.TrimSuffix(expected, "*"))
+	default:
+		return got == expected
+	}
+}
+
+func (check *jsonAssertionYML) violation(doc interface{}) string {
+	got, found := check.lookup(doc)
+	if check.Exists != nil && *check.Exists != found {
+		if found {
+			return fmt.Sprintf("%s: should not exist", check.Path)
+		}
+		return fmt.Sprintf("%s: missing", check.Path)
+	}
+	if check.equals != nil {
+		if !found {
+			return fmt.Sprintf("%s: missing", check.Path)
+		}
+		if !reflect.DeepEqual(got, check.equals) {
+			gotJSON, _ := json.Marshal(got)
+			expectedJSON, _ := json.Marshal(check.equals)
+			return fmt.Sprintf("%s: got %s, expected %s", check.Path, gotJSON, expectedJSON)
+		}
+	}
+	return ""
+}
+
+func (check *jsonAssertionYML) lookup(doc interface{}) (value interface{}, found bool) {
+	value = doc
+	for _, step := range check.steps {
+		if step.isIndex {
+			array, ok := value.([]interface{})
+			if !ok || step.index >= len(array) {
+				return nil, false
+			}
+			value = array[step.index]
+			continue
+		}
+
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[step.key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// parseJSONPath supports $, .key, ['key'] and [index]
+func parseJSONPath(expr string) (steps []jsonPathStep, err error) {
+	if !strings.HasPrefix(expr, "$") {
+		err = fmt.Errorf("JSONPath %q should start with $", expr)
+		return
+	}
+
+	rest := expr[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[") + 1
+			if end == 0 {
+				end = len(rest)
+			}
+			if end == 1 {
+				err = fmt.Errorf("JSONPath %q has an empty key", expr)
+				return
+			}
+			steps = append(steps, jsonPathStep{key: rest[1:end]})
+			rest = rest[end:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end == -1 {
+				err = fmt.Errorf("JSONPath %q lacks a ]", expr)
+				return
+			}
+			inside := rest[1:end]
+			if len(inside) >= 2 && (inside[0] == '\'' || inside[0] == '"') && inside[len(inside)-1] == inside[0] {
+				steps = append(steps, jsonPathStep{key: inside[1 : len(inside)-1]})
+			} else {
+				var index int
+				if index, err = strconv.Atoi(inside); err != nil || index < 0 {
+					err = fmt.Errorf("JSONPath %q has a bad index [%s]", expr, inside)
+					return
+				}
+				steps = append(steps, jsonPathStep{index: index, isIndex: true})
+			}
+			rest = rest[end+1:]
+		default:
+			err = fmt.Errorf("JSONPath %q is not supported", expr)
+			return
+		}
+	}
+	return
+}
+
+// asJSON converts a value decoded from YAML into what decoding JSON would give
+func asJSON(value interface{}) (converted interface{}, err error) {
+	data, err := json.Marshal(yamlToJSONable(value))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &converted)
+	return
+}
+
+func yamlToJSONable(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			object[fmt.Sprintf("%v", key)] = yamlToJSONable(val)
+		}
+		return object
+	case []interface{}:
+		array := make([]interface{}, len(v))
+		for i, val := range v {
+			array[i] = yamlToJSONable(val)
+		}
+		return array
+	default:
+		return v
+	}
+}
+
+func containsInt(ints []int, n int) bool {
+	for _, i := range ints {
+		if i == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-yaml/yaml"
+)
+
+func compiledAssertions(t *testing.T, yml string) (assertions []*assertionYML) {
+	if err := yaml.Unmarshal([]byte(yml), &assertions); err != nil {
+		t.Fatal(err)
+	}
+	if err := compileAssertions(assertions); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func jsonResponse(status int, header http.Header, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     header,
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestAssertionsFor(t *testing.T) {
+	cfg := &ymlCfg{Assertions: compiledAssertions(t, `
+- method: GET
+  path: /items/*
+- method: post
+- path: /
+`)}
+	for _, c := range []struct {
+		method, URL string
+		expected    []int
+	}{
+		{"GET", "http://localhost/items/42?x=1", []int{0}},
+		{"GET", "http://localhost/items/42/tags", nil},
+		{"POST", "http://localhost/items", []int{1}},
+		{"POST", "http://localhost/", []int{1, 2}},
+		{"DELETE", "http://localhost/", []int{2}},
+	} {
+		var got []int
+		for _, assertion := range cfg.assertionsFor(c.method, c.URL) {
+			for i := range cfg.Assertions {
+				if cfg.Assertions[i] == assertion {
+					got = append(got, i)
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s %s: expected assertions %v, got %v", c.method, c.URL, c.expected, got)
+		}
+	}
+}
+
+func TestViolations(t *testing.T) {
+	assertions := compiledAssertions(t, `
+- status: [200]
+  headers:
+    Content-Type: application/json*
+    X-Request-Id: '*'
+  json:
+    - path: $.ok
+      equals: true
+    - path: $.error
+      exists: false
+`)
+	header := http.Header{"Content-Type": {"application/json; charset=utf-8"}, "X-Request-Id": {""}}
+
+	if found := violations(assertions, jsonResponse(200, header, `{"ok":true}`), 0); len(found) != 0 {
+		t.Errorf("expected no violations, got %q", found)
+	}
+
+	found := violations(assertions, jsonResponse(500, http.Header{}, `{"ok":false,"error":"oops"}`), 0)
+	expected := []string{
+		`status 500 is not one of [200]`,
+		`header Content-Type: got "", expected "application/json*"`,
+		`header X-Request-Id: got "", expected "*"`,
+		`$.ok: got false, expected true`,
+		`$.error: should not exist`,
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected violations %q, got %q", expected, found)
+	}
+
+	found = violations(assertions, jsonResponse(200, header, `<html>`), 0)
+	expected = []string{`$.ok: body is not JSON`, `$.error: body is not JSON`}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected violations %q, got %q", expected, found)
+	}
+}
+
+func TestJSONPathLookup(t *testing.T) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(`{"items": [{"id": 42, "a b": [null]}], "ok": true}`), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expected := range map[string]string{
+		"$":                     `{"items":[{"a b":[null],"id":42}],"ok":true}`,
+		"$.ok":                  `true`,
+		"$.items[0].id":         `42`,
+		"$['items'][0]['a b']":  `[null]`,
+		`$.items[0]["a b"][0]`:  `null`,
+		"$.items[1]":            ``,
+		"$.ok.nope":             ``,
+		"$.items[0].id.deeper":  ``,
+		"$.items[0]['missing']": ``,
+	} {
+		check := &jsonAssertionYML{Path: path}
+		var err error
+		if check.steps, err = parseJSONPath(path); err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+
+		got := ``
+		if value, found := check.lookup(doc); found {
+			data, _ := json.Marshal(value)
+			got = string(data)
+		}
+		if got != expected {
+			t.Errorf("%s: expected %q, got %q", path, expected, got)
+		}
+	}
+}
+
+func TestJSONPathUnsupported(t *testing.T) {
+	for _, path := range []string{"", "items", "$..items", "$.items[", "$.items[-1]", "$.items[*]", "$x"} {
+		if _, err := parseJSONPath(path); err == nil {
+			t.Errorf("%q: expected an error", path)
+		}
+	}
+}
+
+func TestViolationsMaxLatency(t *testing.T) {
+	assertions := compiledAssertions(t, `[{max_latency: 250ms}]`)
+	for us, expected := range map[uint64][]string{
+		250000: nil,
+		250001: {"latency 250.001ms exceeds 250ms"},
+	} {
+		if found := violations(assertions, jsonResponse(200, http.Header{}, ``), us); !reflect.DeepEqual(found, expected) {
+			t.Errorf("%dμs: expected violations %q, got %q", us, expected, found)
+		}
+	}
+
+	if err := compileAssertions([]*assertionYML{{MaxLatency: "250"}}); err == nil {
+		t.Error("expected an error for a duration without unit")
+	}
+}
+
+func TestWarnIfAssertionsIgnored(t *testing.T) {
+	oldV := protocolV
+	defer func() { protocolV = oldV }()
+
+	cfg := &ymlCfg{Assertions: compiledAssertions(t, `[{status: [200]}]`)}
+	for _, c := range []struct {
+		v      uint
+		cfg    *ymlCfg
+		warned bool
+	}{
+		{1, cfg, true},
+		{1, &ymlCfg{}, false},
+		{2, cfg, false},
+		{1, &ymlCfg{Assertions: compiledAssertions(t, `[{max_latency: 250ms}]`)}, true},
+	} {
+		protocolV = c.v
+		output := captureStdout(t, func() { warnIfAssertionsIgnored(c.cfg) })
+		if warned := output != ""; warned != c.warned {
+			t.Errorf("v%d with %d assertions: expected warned=%v, got %q", c.v, len(c.cfg.Assertions), c.warned, output)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sebcat/har"
+)
+
+const (
+	authorizationHeader = "Authorization"
+	// oauth2RefreshMargin is how long before their expiry tokens get refreshed
+	oauth2RefreshMargin = 30 * time.Second
+)
+
+// authYML describes the credentials added to every request.
+// All values may use {{ env "VAR" }}.
+type authYML struct {
+	// Headers are set as is
+	Headers map[string]string `yaml:"headers"`
+	Basic   *basicAuthYML     `yaml:"basic"`
+	OAuth2  *oauth2YML        `yaml:"oauth2"`
+}
+
+type basicAuthYML struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// oauth2YML configures the OAuth2 client credentials grant
+type oauth2YML struct {
+	TokenURL     string   `yaml:"token_url"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	Scopes       []string `yaml:"scopes"`
+}
+
+// oauth2Token is a cached access token
+type oauth2Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	expiry      time.Time
+}
+
+func (auth *authYML) isSet() bool {
+	return len(auth.Headers) != 0 || auth.Basic != nil || auth.OAuth2 != nil
+}
+
+// headerNames lists the headers credentials get sent in
+func (auth *authYML) headerNames() (names []string) {
+	for name := range auth.Headers {
+		names = append(names, name)
+	}
+	if auth.Basic != nil || auth.OAuth2 != nil {
+		names = append(names, authorizationHeader)
+	}
+	return
+}
+
+func (token *oauth2Token) isFresh() bool {
+	return token.expiry.IsZero() || time.Now().Before(token.expiry)
+}
+
+// finalizeAuth resolves the env templates of cfg.Auth
+func finalizeAuth(cfg *ymlCfg) (err error) {
+	final := &authYML{Headers: make(map[string]string, len(cfg.Auth.Headers))}
+	for name, value := range cfg.Auth.Headers {
+		if final.Headers[name], err = unstache(value); err != nil {
+			return
+		}
+	}
+	if basic := cfg.Auth.Basic; basic != nil {
+		final.Basic = &basicAuthYML{Username: basic.Username, Password: basic.Password}
+		if err = unstacheAll(&final.Basic.Username, &final.Basic.Password); err != nil {
+			return
+		}
+	}
+	if oauth2 := cfg.Auth.OAuth2; oauth2 != nil {
+		final.OAuth2 = &oauth2YML{
+			TokenURL:     oauth2.TokenURL,
+			ClientID:     oauth2.ClientID,
+			ClientSecret: oauth2.ClientSecret,
+			Scopes:       oauth2.Scopes,
+		}
+		if err = unstacheAll(&final.OAuth2.TokenURL, &final.OAuth2.ClientID, &final.OAuth2.ClientSecret); err != nil {
+			return
+		}
+	}
+
+	cfg.FinalAuth = final
+	// Credentials may have changed
+	cfg.OAuth2Token = nil
+	return
+}
+
+// updateAuth sets the credentials headers, overriding any found in the request.
+// Failing to get an OAuth2 token is retried on the next request.
+func (cmd *reqCmd) updateAuth(cfg *ymlCfg) {
+	auth := cfg.FinalAuth
+	if auth == nil {
+		return
+	}
+
+	names := make([]string, 0, len(auth.Headers))
+	for name := range auth.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd.setHeader(name, auth.Headers[name])
+	}
+
+	if auth.Basic != nil {
+		r := &http.Request{Header: make(http.Header)}
+		r.SetBasicAuth(auth.Basic.Username, auth.Basic.Password)
+		cmd.setHeader(authorizationHeader, r.Header.Get(authorizationHeader))
+	}
+
+	if auth.OAuth2 != nil {
+		if cfg.OAuth2Token == nil || !cfg.OAuth2Token.isFresh() {
+			if token, err := fetchOAuth2Token(cfg, auth.OAuth2); err == nil {
+				cfg.OAuth2Token = token
+			}
+		}
+		if cfg.OAuth2Token != nil {
+			cmd.setHeader(authorizationHeader, "Bearer "+cfg.OAuth2Token.AccessToken)
+		}
+	}
+}
+
+func (cmd *reqCmd) setHeader(name, value string) {
+	// A copy, as reproductions share the original's headers
+	headers := make([]har.NVP, 0, len(cmd.HARRequest.Headers)+1)
+	for _, header := range cmd.HARRequest.Headers {
+		if !strings.EqualFold(header.Name, name) {
+			headers = append(headers, header)
+		}
+	}
+	cmd.HARRequest.Headers = append(headers, har.NVP{Name: name, Value: value})
+}
+
+func fetchOAuth2Token(cfg *ymlCfg, oauth2 *oauth2YML) (token *oauth2Token, err error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(oauth2.Scopes) != 0 {
+		form.Set("scope", strings.Join(oauth2.Scopes, " "))
+	}
+
+	r, err := http.NewRequest(http.MethodPost, oauth2.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		log.Println("[ERR]", err)
+		fmt.Printf("Could not use OAuth2 token URL '%s'\n", oauth2.TokenURL)
+		return
+	}
+	r.SetBasicAuth(url.QueryEscape(oauth2.ClientID), url.QueryEscape(oauth2.ClientSecret))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Accept", mimeJSON)
+	r.Header.Set("User-Agent", binTitle)
+
+	log.Printf("[DBG] 🡱  POST %s\n", oauth2.TokenURL)
+	transport := oauth2Transport(cfg)
+	// Tokens are seldom fetched: no need to keep connections around
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport, Timeout: cfg.Timeouts.Request}
+	start := time.Now()
+	resp, err := client.Do(r)
+	if err != nil {
+		log.Println("[ERR]", err)
+		fmt.Printf("Could not get an OAuth2 token from %s\n", oauth2.TokenURL)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = newStatusError(http.StatusOK, resp.Status)
+		log.Println("[ERR]", err)
+		fmt.Printf("Could not get an OAuth2 token from %s: %s\n", oauth2.TokenURL, err)
+		return
+	}
+
+	token = &oauth2Token{}
+	if err = json.NewDecoder(resp.Body).Decode(token); err != nil {
+		log.Println("[ERR]", err)
+		fmt.Printf("Could not read the OAuth2 token from %s\n", oauth2.TokenURL)
+		return
+	}
+	if token.AccessToken == "" {
+		err = fmt.Errorf("no access_token in response from %s", oauth2.TokenURL)
+		log.Println("[ERR]", err)
+		fmt.Println(err)
+		return
+	}
+
+	if token.ExpiresIn > 0 {
+		lifetime := time.Duration(token.ExpiresIn) * time.Second
+		if margin := lifetime / 10; margin < oauth2RefreshMargin {
+			lifetime -= margin
+		} else {
+			lifetime -= oauth2RefreshMargin
+		}
+		token.expiry = start.Add(lifetime)
+	}
+	log.Printf("[NFO] got an OAuth2 token, expiring in %ds\n", token.ExpiresIn)
+	return
+}
+
+// oauth2Transport talks to the token endpoint as to the target,
+// over connections of its own
+func oauth2Transport(cfg *ymlCfg) (transport *http.Transport) {
+	transport = newTargetHTTPTransport(cfg, newTargetDialer(cfg))
+	if transport.TLSClientConfig != nil {
+		// That is the target's name
+		transport.TLSClientConfig.ServerName = ""
+	}
+	return
+}
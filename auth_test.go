@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sebcat/har"
+)
+
+func TestFinalizeAuthReportsTemplateErrors(t *testing.T) {
+	for _, header := range []string{`{{ env "MONKEY_TEST_TENANT" `, `{{ nope }}`} {
+		cfg := &ymlCfg{Auth: authYML{Headers: map[string]string{"X-Tenant": header}}}
+		if err := finalizeAuth(cfg); err == nil || cfg.FinalAuth != nil {
+			t.Errorf("%s: expected an error, got %+v", header, cfg.FinalAuth)
+		}
+	}
+
+	cfg := &ymlCfg{Auth: authYML{Basic: &basicAuthYML{Username: "monkey", Password: "s3cr3t"}}}
+	if err := finalizeAuth(cfg); err != nil || *cfg.FinalAuth.Basic != *cfg.Auth.Basic {
+		t.Errorf("expected credentials as is, got %+v (%v)", cfg.FinalAuth, err)
+	}
+}
+
+func TestOAuth2TokenIsRetriedOverTargetTLS(t *testing.T) {
+	var tokens int64
+	tokenServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&tokens, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		id, secret, _ := r.BasicAuth()
+		if r.PostFormValue("grant_type") != "client_credentials" ||
+			r.PostFormValue("scope") != "read write" ||
+			id != "monkey" || secret != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", mimeJSON)
+		fmt.Fprintln(w, `{"access_token": "t0k3n", "token_type": "bearer", "expires_in": 3600}`)
+	}))
+	defer tokenServer.Close()
+	dir, err := ioutil.TempDir("", binName+"_auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeKeyPair(t, dir, tokenServer.TLS.Certificates[0])
+
+	// The target's server name is not the token endpoint's
+	tlsYML := &targetTLSYML{CAFile: filepath.Join(dir, "sut.pem"), ServerName: "sut.example.org"}
+	tlsConfig, err := tlsYML.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ymlCfg{
+		TLSConfig: tlsConfig,
+		Timeouts:  targetTimeouts{Request: timeoutLong},
+		Auth: authYML{OAuth2: &oauth2YML{
+			TokenURL:     tokenServer.URL,
+			ClientID:     "monkey",
+			ClientSecret: "s3cr3t",
+			Scopes:       []string{"read", "write"},
+		}},
+	}
+	if err = finalizeAuth(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"", "Bearer t0k3n", "Bearer t0k3n"} {
+		cmd := &reqCmd{HARRequest: &har.Request{}}
+		cmd.updateAuth(cfg)
+		var got string
+		for _, header := range cmd.HARRequest.Headers {
+			if header.Name == authorizationHeader {
+				got = header.Value
+			}
+		}
+		if got != expected {
+			t.Errorf("expected Authorization %q, got %q", expected, got)
+		}
+	}
+	if tokens := atomic.LoadInt64(&tokens); tokens != 2 {
+		t.Errorf("expected a failed then a cached token, got %d token requests", tokens)
+	}
+}
+
+func TestOAuth2TokenFetchesLeaveNoConnectionOpen(t *testing.T) {
+	var open int64
+	tokenServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", mimeJSON)
+		fmt.Fprintln(w, `{"access_token": "t0k3n", "token_type": "bearer"}`)
+	}))
+	tokenServer.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt64(&open, 1)
+		case http.StateClosed, http.StateHijacked:
+			atomic.AddInt64(&open, -1)
+		}
+	}
+	tokenServer.Start()
+	defer tokenServer.Close()
+
+	cfg := &ymlCfg{Timeouts: targetTimeouts{Request: timeoutLong}}
+	for i := 0; i < 3; i++ {
+		if _, err := fetchOAuth2Token(cfg, &oauth2YML{TokenURL: tokenServer.URL}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for start := time.Now(); atomic.LoadInt64(&open) != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("expected no open connections, got %d", atomic.LoadInt64(&open))
+		}
+	}
+}
+
+func TestUpdateAuthOverridesHeaders(t *testing.T) {
+	cfg := &ymlCfg{FinalAuth: &authYML{
+		Headers: map[string]string{"X-Api-Key": "k3y"},
+		Basic:   &basicAuthYML{Username: "monkey", Password: "s3cr3t"},
+	}}
+	cmd := &reqCmd{HARRequest: &har.Request{Headers: []har.NVP{
+		{Name: "Accept", Value: "*/*"},
+		{Name: "authorization", Value: "Bearer nope"},
+	}}}
+	cmd.updateAuth(cfg)
+
+	expected := []har.NVP{
+		{Name: "Accept", Value: "*/*"},
+		{Name: "X-Api-Key", Value: "k3y"},
+		{Name: authorizationHeader, Value: "Basic bW9ua2V5OnMzY3IzdA=="},
+	}
+	if !reflect.DeepEqual(cmd.HARRequest.Headers, expected) {
+		t.Errorf("expected %+v, got %+v", expected, cmd.HARRequest.Headers)
+	}
+}
+
+func TestAuthIsRedactedFromReports(t *testing.T) {
+	var reporting reportingYML
+	reporting.redact((&authYML{Headers: map[string]string{"X-Api-Key": "k3y"}}).headerNames()...)
+
+	entry := &harLogEntry{}
+	entry.Request.Headers = []har.NVP{
+		{Name: "Accept", Value: "*/*"},
+		{Name: "Authorization", Value: "Basic bW9ua2V5OnMzY3IzdA=="},
+		{Name: "Cookie", Value: "session=42"},
+		{Name: "X-API-KEY", Value: "k3y"},
+	}
+	expected := []har.NVP{
+		{Name: "Accept", Value: "*/*"},
+		{Name: "Authorization", Value: redactedValue},
+		{Name: "Cookie", Value: redactedValue},
+		{Name: "X-API-KEY", Value: redactedValue},
+	}
+	if got := reporting.report(entry).Request.Headers; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// batchCmd carries the consecutive requests of one test.
+// Its lane is the first request's: following requests increment lane.R.
+type batchCmd struct {
+	V           uint         `json:"v"`
+	Cmd         cmdKind      `json:"cmd"`
+	Lane        lane         `json:"lane"`
+	HARRequests []harRequest `json:"har_reqs"`
+}
+
+type batchCmdRep struct {
+	V    uint         `json:"v"`
+	Cmd  cmdKind      `json:"cmd"`
+	Lane lane         `json:"lane"`
+	Us   uint64       `json:"us"`
+	Reps []*reqCmdRep `json:"reps"`
+}
+
+func init() {
+	registerCmd(kindBatch, 2, &cmdCodec{
+		isValid: isValidForSchemaBATCHv2,
+		newCmd:  func() aCmd { return &batchCmd{} },
+	})
+}
+
+func (cmd *batchCmd) Kind() cmdKind {
+	return cmd.Cmd
+}
+
+// Exec runs requests back to back, stopping after the first one
+// that did not get a response.
+func (cmd *batchCmd) Exec(cfg *ymlCfg) (rep []byte, err error) {
+	cmdRep := &batchCmdRep{
+		V:    protocolV,
+		Cmd:  cmd.Cmd,
+		Lane: cmd.Lane,
+		Reps: make([]*reqCmdRep, 0, len(cmd.HARRequests)),
+	}
+
+	for i, harReq := range cmd.HARRequests {
+		req := &reqCmd{
+			V:          cmd.V,
+			Cmd:        kindReq,
+			Lane:       lane{T: cmd.Lane.T, R: cmd.Lane.R + uint(i)},
+			HARRequest: harReq,
+		}
+
+		var reqRep *reqCmdRep
+		if reqRep, err = req.execute(cfg); err != nil {
+			return
+		}
+		cmdRep.Us += reqRep.Us
+		cmdRep.Reps = append(cmdRep.Reps, reqRep)
+		if reqRep.Reason != "" {
+			break
+		}
+	}
+
+	if rep, err = json.Marshal(cmdRep); err != nil {
+		log.Println("[ERR]", err)
+	}
+	return
+}
@@ -11,6 +11,12 @@ type doneCmd struct {
 	Failure bool    `json:"failure"`
 }
 
+func init() {
+	newCmd := func() aCmd { return &doneCmd{} }
+	registerCmd(kindDone, 1, &cmdCodec{isValid: isValidForSchemaCMDDonev1, newCmd: newCmd})
+	registerCmd(kindDone, 2, &cmdCodec{isValid: isValidForSchemaCMDDonev2, newCmd: newCmd})
+}
+
 func (cmd *doneCmd) Kind() cmdKind {
 	return cmd.Cmd
 }
@@ -22,6 +28,7 @@ func (cmd *doneCmd) Exec(cfg *ymlCfg) ([]byte, error) {
 func fuzzOutcome(cmd *doneCmd) int {
 	os.Stdout.Write([]byte{'\n'})
 	fmt.Printf("Ran %d tests totalling %d requests\n", lastLane.T, totalR)
+	printLatencies()
 
 	if cmd.Failure {
 		d, m := shrinkingFrom.T, lastLane.T-shrinkingFrom.T
@@ -30,6 +37,13 @@ func fuzzOutcome(cmd *doneCmd) int {
 		} else {
 			fmt.Printf("A bug was detected after %d tests then shrunk once!\n", d)
 		}
+		if _, err := os.Stat(reproID()); err == nil {
+			if worker := os.Getenv(envWorker); worker != "" {
+				fmt.Printf("Try: %s=%s %s repro\n", envWorker, worker, binName)
+			} else {
+				fmt.Printf("Try: %s repro\n", binName)
+			}
+		}
 		return 6
 	}
 	fmt.Println("No bugs found... yet.")
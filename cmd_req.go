@@ -11,6 +11,9 @@ import (
 	"github.com/sebcat/har"
 )
 
+// reasonTimeout prefixes the Reason of requests that took too long
+const reasonTimeout = "timeout: "
+
 type harRequest *har.Request
 
 type reqCmd struct {
@@ -27,6 +30,16 @@ type reqCmdRep struct {
 	Us       uint64   `json:"us"`
 	HAREntry harEntry `json:"har_rep,omitempty"`
 	Reason   string   `json:"reason,omitempty"`
+	// Failure classifies Reason. Not sent over protocol v1.
+	Failure failureKind `json:"failure,omitempty"`
+	// Violations lists the assertions the response failed. Not sent over protocol v1.
+	Violations []string `json:"violations,omitempty"`
+}
+
+func init() {
+	newCmd := func() aCmd { return &reqCmd{} }
+	registerCmd(kindReq, 1, &cmdCodec{isValid: isValidForSchemaREQv1, newCmd: newCmd})
+	registerCmd(kindReq, 2, &cmdCodec{isValid: isValidForSchemaREQv2, newCmd: newCmd})
 }
 
 func (cmd *reqCmd) Kind() cmdKind {
@@ -34,70 +47,132 @@ func (cmd *reqCmd) Kind() cmdKind {
 }
 
 func (cmd *reqCmd) Exec(cfg *ymlCfg) (rep []byte, err error) {
+	cmdRep, err := cmd.execute(cfg)
+	if err != nil {
+		return
+	}
+
+	if rep, err = json.Marshal(cmdRep); err != nil {
+		log.Println("[ERR]", err)
+	}
+	return
+}
+
+func (cmd *reqCmd) execute(cfg *ymlCfg) (cmdRep *reqCmdRep, err error) {
 	lastLane = cmd.Lane
+	target, err := cfg.targetURL()
+	if err != nil {
+		return
+	}
 	if !isHARReady() {
-		newHARTransport()
+		newHARTransport(cfg, target)
 	}
 
+	// Reproductions get rewritten again
+	original := copyHARRequest(cmd.HARRequest)
+	checks := cfg.assertionsFor(original.Method, original.URL)
 	cmd.updateUserAgent()
-	if err = cmd.updateURL(cfg); err != nil {
+	if err = cmd.updateURL(target); err != nil {
 		return
 	}
-	cmdRep, err := cmd.makeRequest()
-	if err != nil {
+	cmd.updateAuth(cfg)
+	if cmdRep, err = cmd.makeRequest(cfg, checks); err != nil {
 		return
 	}
+	collectRepro(cmd.Lane, &original)
+	if cmdRep.Reason == "" {
+		recordLatency(original.Method, original.URL, cmdRep.Us)
+	}
 	totalR++
+	return
+}
 
-	if rep, err = json.Marshal(cmdRep); err != nil {
-		log.Println("[ERR]", err)
-	}
+// copyHARRequest copies req deep enough for the copy to stay as is
+// while req's headers & query get rewritten.
+func copyHARRequest(req *har.Request) (copied har.Request) {
+	copied = *req
+	copied.Headers = append([]har.NVP(nil), req.Headers...)
+	copied.QueryString = append([]har.NVP(nil), req.QueryString...)
 	return
 }
 
-func (cmd *reqCmd) makeRequest() (rep *reqCmdRep, err error) {
+func (cmd *reqCmd) makeRequest(cfg *ymlCfg, checks []*assertionYML) (rep *reqCmdRep, err error) {
 	r, err := (*cmd.HARRequest).Request()
 	if err != nil {
 		log.Println("[ERR]", err)
 		return
 	}
+	if err = cmd.signRequest(cfg, r); err != nil {
+		return
+	}
 
 	log.Printf("[NFO] 🡳\n  ▲  %+v\n", cmd.HARRequest)
 	start := time.Now()
-	_, err = clientReq.Do(r)
+	resp, err := clientReq.Do(r)
+	if err == nil {
+		err = readBody(resp, needsBody(checks))
+	}
 	us := uint64(time.Since(start) / time.Microsecond)
 	log.Printf("[NFO] ❙ %dμs\n", us)
 	rep = &reqCmdRep{
-		V:    v,
+		V:    cmd.V,
 		Cmd:  cmd.Cmd,
 		Us:   us,
 		Lane: cmd.Lane,
 	}
 
 	if err != nil {
-		//FIXME: is there a way to describe these failures in HAR 1.2?
 		rep.Reason = fmt.Sprintf("%+v", err.Error())
-		log.Printf("[NFO]\n  ▼  %s\n", rep.Reason)
+		failure := classifyFailure(err)
+		if failure == failureTimeout {
+			rep.Reason = reasonTimeout + rep.Reason
+		}
+		log.Printf("[NFO]\n  ▼  %s: %s\n", failure, rep.Reason)
+		if cmd.V != 1 {
+			rep.Failure = failure
+		}
 		err = nil
 		return
 	}
 
-	//FIXME maybe: append(headers, fmt.Sprintf("Host: %v", resp.Host))
-	//FIXME: make sure order is preserved github.com/golang/go/issues/21853
-	rep.HAREntry = lastHAR()
+	rep.HAREntry = cfg.Reporting.report(lastHAR())
 	log.Printf("[NFO]\n  ▼  %+v\n", rep.HAREntry)
+	found := violations(checks, resp, us)
+	if cmd.V != 1 {
+		rep.Violations = found
+	} else if len(found) != 0 {
+		log.Println("[NFO] protocol v1 cannot report these violations")
+	}
+	resp.Body.Close()
 	return
 }
 
-func (cmd *reqCmd) updateURL(cfg *ymlCfg) (err error) {
+// updateURL points the request at the target, prefixing its path
+// with the target's own.
+func (cmd *reqCmd) updateURL(target *url.URL) (err error) {
 	URL, err := url.Parse(cmd.HARRequest.URL)
 	if err != nil {
 		log.Println("[ERR]", err)
 		return
 	}
 
-	// TODO: if host is an IPv6 then it has to be braced with []
-	URL.Host = cfg.FinalHost + ":" + cfg.FinalPort
+	if target.Scheme == schemeUnix {
+		URL.Scheme, URL.Host = "http", unixHost
+	} else {
+		if target.Scheme != "" {
+			URL.Scheme = target.Scheme
+		}
+		URL.Host = target.Host
+
+		if prefix := strings.TrimSuffix(target.EscapedPath(), "/"); prefix != "" {
+			escaped := prefix + URL.EscapedPath()
+			if URL.Path, err = url.PathUnescape(escaped); err != nil {
+				log.Println("[ERR]", err)
+				return
+			}
+			URL.RawPath = escaped
+		}
+	}
 	cmd.HARRequest.URL = URL.String()
 	return
 }
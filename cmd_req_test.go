@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sebcat/har"
+)
+
+func TestCopyHARRequestIsNotRewritten(t *testing.T) {
+	req := &har.Request{
+		Method:      "GET",
+		URL:         "http://localhost/items?q=1",
+		Headers:     []har.NVP{{Name: "User-Agent", Value: "FuzzyMonkey.co/"}},
+		QueryString: []har.NVP{{Name: "q", Value: "1"}},
+	}
+	copied := copyHARRequest(req)
+
+	req.Headers[0].Value = binTitle
+	req.QueryString[0].Value = "2"
+	if copied.Headers[0].Value != "FuzzyMonkey.co/" || copied.QueryString[0].Value != "1" {
+		t.Errorf("copy was rewritten: %+v", copied)
+	}
+}
+
+func TestReqRepOmitsFailureAndViolationsFromV1Cmds(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedURL := "http://" + listener.Addr().String()
+	listener.Close()
+
+	// As when replaying or reproducing: the command's version is what counts
+	oldV, oldLatencies, oldRepro := protocolV, latencies, repro
+	protocolV, latencies = 1, make(map[string][]uint64)
+	defer func() {
+		protocolV, latencies, repro = oldV, oldLatencies, oldRepro
+		clearHAR()
+	}()
+
+	for _, c := range []struct {
+		target, field string
+	}{
+		{server.URL, "violations"},
+		{closedURL, "failure"},
+	} {
+		for _, v := range []uint{1, 2} {
+			clearHAR()
+			cfg := &ymlCfg{
+				FinalTarget: c.target,
+				Assertions:  []*assertionYML{{Status: []int{http.StatusOK}}},
+			}
+			cmd := &reqCmd{V: v, Cmd: kindReq, Lane: lane{T: 1, R: 1}, HARRequest: &har.Request{
+				Method: "GET", URL: "http://localhost/", HTTPVersion: "HTTP/1.1",
+			}}
+			data, err := cmd.Exec(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rep map[string]interface{}
+			if err = json.Unmarshal(data, &rep); err != nil {
+				t.Fatal(err)
+			}
+			if _, sent := rep[c.field]; sent != (v != 1) {
+				t.Errorf("v%d: expected %s to be sent=%v, got %s", v, c.field, v != 1, data)
+			}
+		}
+	}
+}
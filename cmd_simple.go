@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
 	"text/template"
 	"time"
@@ -41,6 +42,14 @@ type simpleCmdRep struct {
 	Failed bool    `json:"failed"`
 }
 
+func init() {
+	newCmd := func() aCmd { return &simpleCmd{} }
+	for _, kind := range []cmdKind{kindStart, kindReset, kindStop} {
+		registerCmd(kind, 1, &cmdCodec{isValid: isValidForSchemaCMDv1, newCmd: newCmd})
+		registerCmd(kind, 2, &cmdCodec{isValid: isValidForSchemaCMDv2, newCmd: newCmd})
+	}
+}
+
 func (cmd *simpleCmd) Kind() cmdKind {
 	return cmd.Cmd
 }
@@ -48,6 +57,7 @@ func (cmd *simpleCmd) Kind() cmdKind {
 func (cmd *simpleCmd) Exec(cfg *ymlCfg) (rep []byte, err error) {
 	if isHARReady() {
 		progress(cmd)
+		maybeSaveRepro(cmd)
 		clearHAR()
 	}
 
@@ -96,7 +106,7 @@ func progress(cmd *simpleCmd) {
 }
 
 func executeScript(cfg *ymlCfg, kind cmdKind) (cmdRep *simpleCmdRep) {
-	cmdRep = &simpleCmdRep{V: v, Cmd: kind, Failed: false}
+	cmdRep = &simpleCmdRep{V: protocolV, Cmd: kind, Failed: false}
 	shellCmds := cfg.script(kind)
 	if len(shellCmds) == 0 {
 		return
@@ -119,7 +129,9 @@ func executeScript(cfg *ymlCfg, kind cmdKind) (cmdRep *simpleCmdRep) {
 		}
 	}
 
-	maybeFinalizeConf(cfg, kind)
+	if err = maybeFinalizeConf(cfg, kind); err != nil {
+		cmdRep.Failed = true
+	}
 	return
 }
 
@@ -243,45 +255,94 @@ func unstacheEnv(envVar string) (envVal string, err error) {
 	return
 }
 
-func unstache(field string) string {
-	if field[:2] != "{{" {
-		return field
+// unstache resolves templates such as {{ env "VAR" }}
+func unstache(field string) (value string, err error) {
+	if !strings.Contains(field, "{{") {
+		value = field
+		return
 	}
 
 	funcMap := template.FuncMap{
 		"env": unstacheEnv,
 	}
-	tmpl := template.New("unstache").Funcs(funcMap)
-
-	var err error
-	if tmpl, err = tmpl.Parse(field); err != nil {
-		log.Panic("[ERR] ", err)
+	tmpl, err := template.New("unstache").Funcs(funcMap).Parse(field)
+	if err != nil {
+		log.Println("[ERR]", err)
+		fmt.Printf("Could not parse template '%s'\n", field)
+		return
 	}
 	var buffer bytes.Buffer
-	if err := tmpl.Execute(&buffer, ""); err != nil {
-		log.Panic("[ERR] ", err)
+	if err = tmpl.Execute(&buffer, ""); err != nil {
+		log.Println("[ERR]", err)
+		fmt.Printf("Could not resolve template '%s': %s\n", field, err)
+		return
 	}
-	return buffer.String()
+	value = buffer.String()
+	return
 }
 
-func maybeFinalizeConf(cfg *ymlCfg, kind cmdKind) {
-	var wg sync.WaitGroup
+// unstacheAll resolves the templates of fields in place
+func unstacheAll(fields ...*string) (err error) {
+	for _, field := range fields {
+		if *field, err = unstache(*field); err != nil {
+			return
+		}
+	}
+	return
+}
 
-	if cfg.FinalHost == "" || kind != kindReset {
+func maybeFinalizeConf(cfg *ymlCfg, kind cmdKind) (err error) {
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	finalize := func(f func() error) {
 		wg.Add(1)
 		go func() {
-			cfg.FinalHost = unstache(cfg.Host)
+			errs <- f()
 			wg.Done()
 		}()
 	}
 
+	if cfg.FinalHost == "" || kind != kindReset {
+		finalize(func() (err error) {
+			cfg.FinalHost, err = unstache(cfg.Host)
+			return
+		})
+	}
+
 	if cfg.FinalPort == "" || kind != kindReset {
-		wg.Add(1)
-		go func() {
-			cfg.FinalPort = unstache(cfg.Port)
-			wg.Done()
-		}()
+		finalize(func() (err error) {
+			cfg.FinalPort, err = unstache(cfg.Port)
+			return
+		})
+	}
+
+	checkTarget := cfg.Target != "" && (cfg.FinalTarget == "" || kind != kindReset)
+	if checkTarget {
+		finalize(func() (err error) {
+			cfg.FinalTarget, err = unstache(cfg.Target)
+			return
+		})
+	}
+
+	if cfg.Auth.isSet() && (cfg.FinalAuth == nil || kind != kindReset) {
+		finalize(func() error { return finalizeAuth(cfg) })
+	}
+
+	if cfg.Signing.isSet() && (cfg.FinalSigning == nil || kind != kindReset) {
+		finalize(func() error { return finalizeSigning(cfg) })
 	}
 
 	wg.Wait()
+	close(errs)
+	for someErr := range errs {
+		if err == nil {
+			err = someErr
+		}
+	}
+	if err == nil && checkTarget {
+		// Fail early on settings that do not fit the target.
+		// Host & port are final by now, should the target resolve to nothing.
+		_, err = cfg.targetURL()
+	}
+	return
 }
@@ -4,12 +4,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 )
 
 var (
 	lastLane      lane
 	shrinkingFrom lane
 	totalR        uint
+	lastReplySeq  uint
 )
 
 type lane struct {
@@ -30,16 +33,20 @@ const (
 	kindReset
 	kindStop
 	kindDone
+	kindBatch
 )
 
+var cmdKindNames = map[cmdKind]string{
+	kindReq:   "req",
+	kindReset: "reset",
+	kindStart: "start",
+	kindStop:  "stop",
+	kindDone:  "done",
+	kindBatch: "batch",
+}
+
 func (k cmdKind) String() string {
-	return map[cmdKind]string{
-		kindReq:   "req",
-		kindReset: "reset",
-		kindStart: "start",
-		kindStop:  "stop",
-		kindDone:  "done",
-	}[k]
+	return cmdKindNames[k]
 }
 
 func (k *cmdKind) UnmarshalJSON(data []byte) (err error) {
@@ -48,75 +55,89 @@ func (k *cmdKind) UnmarshalJSON(data []byte) (err error) {
 		return
 	}
 
-	if kind, ok := map[string]cmdKind{
-		"req":   kindReq,
-		"reset": kindReset,
-		"start": kindStart,
-		"stop":  kindStop,
-		"done":  kindDone,
-	}[cmd]; ok {
-		*k = kind
-		return
+	var names []string
+	for kind, name := range cmdKindNames {
+		if name == cmd {
+			*k = kind
+			return
+		}
+		names = append(names, name)
 	}
-	err = fmt.Errorf("expected one of req reset start stop done, not %s", cmd)
+	sort.Strings(names)
+	err = fmt.Errorf("expected one of %s, not %s", strings.Join(names, " "), cmd)
 	return
 }
 
 func (k cmdKind) MarshalJSON() (data []byte, err error) {
-	var ok bool
-	if data, ok = map[cmdKind][]byte{
-		kindReq:   []byte("\"req\""),
-		kindReset: []byte("\"reset\""),
-		kindStart: []byte("\"start\""),
-		kindStop:  []byte("\"stop\""),
-		kindDone:  []byte("\"done\""),
-	}[k]; ok {
-		return
+	if name, ok := cmdKindNames[k]; ok {
+		return json.Marshal(name)
 	}
 	err = fmt.Errorf("impossibru %v", k)
 	return
 }
 
-func unmarshalCmd(cmdJSON []byte) (cmd aCmd, err error) {
-	var ok bool
+// cmdCodec describes how to decode one kind of command of one protocol version
+type cmdCodec struct {
+	// isValid checks the command against its JSON schema
+	isValid func(cmdJSON []byte) (bool, error)
+	// newCmd makes an empty command to decode into
+	newCmd func() aCmd
+	// decode fills cmd from cmdJSON. Defaults to json.Unmarshal
+	decode func(cmdJSON []byte, cmd aCmd) error
+}
 
-	if ok, err = isValidForSchemaREQv1(cmdJSON); err != nil {
-		return
+type cmdKey struct {
+	kind cmdKind
+	v    uint
+}
+
+var cmdCodecs = map[cmdKey]*cmdCodec{}
+
+// registerCmd makes unmarshalCmd handle commands of this kind and version
+func registerCmd(kind cmdKind, version uint, codec *cmdCodec) {
+	key := cmdKey{kind, version}
+	if _, ok := cmdCodecs[key]; ok {
+		log.Panicf("[ERR] command %s v%d registered twice", kind, version)
 	}
-	if ok {
-		var cmd reqCmd
-		if err = json.Unmarshal(cmdJSON, &cmd); err != nil {
-			log.Println("[ERR]", err)
-			return nil, err
+	if codec.decode == nil {
+		codec.decode = func(cmdJSON []byte, cmd aCmd) error {
+			return json.Unmarshal(cmdJSON, cmd)
 		}
-		return &cmd, nil
 	}
+	cmdCodecs[key] = codec
+}
 
-	if ok, err = isValidForSchemaCMDv1(cmdJSON); err != nil {
+func unmarshalCmd(cmdJSON []byte) (cmd aCmd, err error) {
+	var header struct {
+		V   uint    `json:"v"`
+		Cmd cmdKind `json:"cmd"`
+	}
+	if err = json.Unmarshal(cmdJSON, &header); err != nil {
+		log.Println("[ERR]", err)
 		return
 	}
-	if ok {
-		var cmd simpleCmd
-		if err = json.Unmarshal(cmdJSON, &cmd); err != nil {
-			log.Println("[ERR]", err)
-			return nil, err
-		}
-		return &cmd, nil
+
+	codec, ok := cmdCodecs[cmdKey{header.Cmd, header.V}]
+	if !ok {
+		err = fmt.Errorf("unsupported command %s v%d", header.Cmd, header.V)
+		log.Println("[ERR]", err)
+		return
 	}
 
-	if ok, err = isValidForSchemaCMDDonev1(cmdJSON); err != nil {
+	if ok, err = codec.isValid(cmdJSON); err != nil {
 		return
 	}
-	if ok {
-		var cmd doneCmd
-		if err = json.Unmarshal(cmdJSON, &cmd); err != nil {
-			log.Println("[ERR]", err)
-			return nil, err
-		}
-		return &cmd, nil
+	if !ok {
+		err = fmt.Errorf("invalid JSON data received")
+		log.Println("[ERR]", err)
+		return
 	}
 
-	err = fmt.Errorf("invalid JSON data received")
-	log.Println("[ERR]", err)
+	someCmd := codec.newCmd()
+	if err = codec.decode(cmdJSON, someCmd); err != nil {
+		log.Println("[ERR]", err)
+		return
+	}
+	cmd = someCmd
 	return
 }
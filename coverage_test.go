@@ -10,6 +10,11 @@ import (
 )
 
 func TestCov(t *testing.T) {
+	path := os.Getenv("MONKEY_CODEFILE")
+	if path == "" {
+		t.Skip("only run through ape.sh")
+	}
+
 	oldArgs := os.Args
 	defer func() { os.Args = oldArgs }()
 
@@ -20,7 +25,6 @@ func TestCov(t *testing.T) {
 
 	fmt.Println("EXIT", code)
 	data := []byte(strconv.Itoa(code))
-	path := os.Getenv("MONKEY_CODEFILE")
 	if err := ioutil.WriteFile(path, data, 0644); err != nil {
 		panic(err)
 	}
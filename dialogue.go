@@ -2,12 +2,12 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"time"
 
 	"github.com/go-yaml/yaml"
 )
@@ -21,14 +21,32 @@ const (
 )
 
 type ymlCfg struct {
-	AuthToken string
-	Host      string
-	Port      string
-	FinalHost string
-	FinalPort string
-	Start     []string
-	Reset     []string
-	Stop      []string
+	AuthToken        string
+	Host             string
+	Port             string
+	Target           string
+	FinalHost        string
+	FinalPort        string
+	FinalTarget      string
+	TLSConfig        *tls.Config
+	Timeouts         targetTimeouts
+	NoKeepAlive      bool
+	FreshConnections bool
+	CookieJar        bool
+	CaptureWire      bool
+	Wire             *wireCapture
+	HTTP2            string
+	Transport        targetRoundTripper
+	Auth             authYML
+	FinalAuth        *authYML
+	OAuth2Token      *oauth2Token
+	Signing          signingYML
+	FinalSigning     *signingYML
+	Assertions       []*assertionYML
+	Reporting        reportingYML
+	Start            []string
+	Reset            []string
+	Stop             []string
 }
 
 func initDialogue(apiKey string) (cfg *ymlCfg, cmd aCmd, err error) {
@@ -56,6 +74,10 @@ func initDialogue(apiKey string) (cfg *ymlCfg, cmd aCmd, err error) {
 	}
 	log.Printf("[NFO] got auth token: %s\n", authToken)
 	cfg.AuthToken = authToken
+	warnIfAssertionsIgnored(cfg)
+	saveSession(cfg, cmdJSON)
+	recordCmd(cmdJSON)
+	maybeOpenStream(cfg)
 
 	cmd, err = unmarshalCmd(cmdJSON)
 	return
@@ -67,13 +89,16 @@ func next(cfg *ymlCfg, cmd aCmd) (someCmd aCmd, err error) {
 	if err != nil {
 		return
 	}
+	recordRep(rep)
 
-	nextCmdJSON, err := nextPOST(cfg, rep)
+	cmdJSON, err := nextCmdJSON(cfg, replyKey(), rep)
 	if err != nil {
 		return
 	}
+	saveSession(cfg, cmdJSON)
+	recordCmd(cmdJSON)
 
-	someCmd, err = unmarshalCmd(nextCmdJSON)
+	someCmd, err = unmarshalCmd(cmdJSON)
 	return
 }
 
@@ -101,18 +126,69 @@ func newCfg(yml []byte) (cfg *ymlCfg, err error) {
 			Host string `yaml:"host"`
 			Port string `yaml:"port"`
 		} `yaml:"documentation"`
+		Target struct {
+			URL              string            `yaml:"url"`
+			TLS              targetTLSYML      `yaml:"tls"`
+			Timeouts         targetTimeoutsYML `yaml:"timeouts"`
+			KeepAlive        *bool             `yaml:"keep_alive"`
+			FreshConnections bool              `yaml:"fresh_connection_per_test"`
+			CookieJar        bool              `yaml:"cookie_jar"`
+			CaptureWire      bool              `yaml:"capture_wire"`
+			HTTP2            string            `yaml:"http2"`
+		} `yaml:"target"`
+		Auth       authYML         `yaml:"auth"`
+		Signing    signingYML      `yaml:"signing"`
+		Assertions []*assertionYML `yaml:"assertions"`
+		Reporting  reportingYML    `yaml:"reporting"`
 	}
 	if err = yaml.Unmarshal(yml, &ymlConf); err != nil {
 		log.Println("[ERR]", err)
 		return
 	}
 
+	tlsConfig, err := ymlConf.Target.TLS.config()
+	if err != nil {
+		return
+	}
+	timeouts, err := ymlConf.Target.Timeouts.parse()
+	if err != nil {
+		return
+	}
+	if err = checkHTTP2(ymlConf.Target.HTTP2); err != nil {
+		return
+	}
+	if hmacSigning := ymlConf.Signing.HMAC; hmacSigning != nil {
+		if err = hmacSigning.check(); err != nil {
+			return
+		}
+	}
+	if err = compileAssertions(ymlConf.Assertions); err != nil {
+		return
+	}
+	if err = ymlConf.Reporting.check(); err != nil {
+		return
+	}
+	ymlConf.Reporting.redact(ymlConf.Auth.headerNames()...)
+	ymlConf.Reporting.redact(ymlConf.Signing.headerNames()...)
+
 	cfg = &ymlCfg{
-		Host:  ymlConf.Doc.Host,
-		Port:  ymlConf.Doc.Port,
-		Start: ymlConf.Start,
-		Reset: ymlConf.Reset,
-		Stop:  ymlConf.Stop,
+		Host:             ymlConf.Doc.Host,
+		Port:             ymlConf.Doc.Port,
+		Target:           ymlConf.Target.URL,
+		TLSConfig:        tlsConfig,
+		Timeouts:         timeouts,
+		NoKeepAlive:      ymlConf.Target.KeepAlive != nil && !*ymlConf.Target.KeepAlive,
+		FreshConnections: ymlConf.Target.FreshConnections,
+		CookieJar:        ymlConf.Target.CookieJar,
+		CaptureWire:      ymlConf.Target.CaptureWire,
+		HTTP2:            ymlConf.Target.HTTP2,
+		Auth:             ymlConf.Auth,
+		Signing:          ymlConf.Signing,
+		Assertions:       ymlConf.Assertions,
+		Reporting:        ymlConf.Reporting,
+		Start:            ymlConf.Start,
+		Reset:            ymlConf.Reset,
+		Stop:             ymlConf.Stop,
 	}
 	return
 }
@@ -136,21 +212,15 @@ func initPUT(apiKey string, JSON []byte) (rep []byte, authToken string, err erro
 	r.Header.Set("Accept", mimeJSON)
 	r.Header.Set("User-Agent", binTitle)
 	r.Header.Set(xAPIKeyHeader, apiKey)
+	advertiseProtocols(r)
 
 	log.Printf("[DBG] 🡱  PUT %s\n  🡱  %s\n", initURL, JSON)
-	start := time.Now()
-	resp, err := clientUtils.Do(r)
-	log.Printf("[DBG] ❙ %dμs\n", time.Since(start)/time.Microsecond)
+	// Creates a session: only retried when it was not received
+	resp, rep, err := doWithRetries(r, false)
 	if err != nil {
 		log.Println("[ERR]", err)
 		return
 	}
-	defer resp.Body.Close()
-
-	if rep, err = ioutil.ReadAll(resp.Body); err != nil {
-		log.Println("[ERR]", err)
-		return
-	}
 	log.Printf("[DBG]\n  🡳  %s\n", rep)
 
 	if resp.StatusCode != 201 {
@@ -159,6 +229,10 @@ func initPUT(apiKey string, JSON []byte) (rep []byte, authToken string, err erro
 		return
 	}
 
+	if err = negotiateProtocol(resp); err != nil {
+		return
+	}
+
 	authToken = resp.Header.Get(xAuthTokenHeader)
 	if authToken == "" {
 		err = fmt.Errorf("Could not acquire an AuthToken")
@@ -168,7 +242,14 @@ func initPUT(apiKey string, JSON []byte) (rep []byte, authToken string, err erro
 	return
 }
 
-func nextPOST(cfg *ymlCfg, payload []byte) (rep []byte, err error) {
+// replyKey identifies a reply so the server can deduplicate resubmissions.
+// Replies are numbered in the order they are sent within a session.
+func replyKey() string {
+	lastReplySeq++
+	return fmt.Sprintf("%d", lastReplySeq)
+}
+
+func nextPOST(cfg *ymlCfg, key string, payload []byte) (rep []byte, err error) {
 	r, err := http.NewRequest(http.MethodPost, nextURL, bytes.NewBuffer(payload))
 	if err != nil {
 		log.Println("[ERR]", err)
@@ -179,21 +260,14 @@ func nextPOST(cfg *ymlCfg, payload []byte) (rep []byte, err error) {
 	r.Header.Set("Accept", mimeJSON)
 	r.Header.Set("User-Agent", binTitle)
 	r.Header.Set(xAuthTokenHeader, cfg.AuthToken)
+	r.Header.Set(xIdempotencyKeyHeader, key)
 
 	log.Printf("[DBG] 🡱  POST %s\n  🡱  %s\n", nextURL, payload)
-	start := time.Now()
-	resp, err := clientUtils.Do(r)
-	log.Printf("[DBG] ❙ %dμs\n", time.Since(start)/time.Microsecond)
+	resp, rep, err := doWithRetries(r, true)
 	if err != nil {
 		log.Println("[ERR]", err)
 		return
 	}
-	defer resp.Body.Close()
-
-	if rep, err = ioutil.ReadAll(resp.Body); err != nil {
-		log.Println("[ERR]", err)
-		return
-	}
 	log.Printf("[DBG]\n  🡳  %s\n", rep)
 
 	if resp.StatusCode != 200 {
@@ -7,7 +7,6 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"time"
 
 	"github.com/go-yaml/yaml"
 )
@@ -53,19 +52,11 @@ func validationReq(apiKey string, JSON []byte) (rep []byte, err error) {
 	}
 
 	log.Printf("[DBG] 🡱  PUT %s\n  🡱  %s\n", lintURL, JSON)
-	start := time.Now()
-	resp, err := clientUtils.Do(r)
-	log.Printf("[DBG] ❙ %dμs\n", time.Since(start)/time.Microsecond)
+	resp, rep, err := doWithRetries(r, true)
 	if err != nil {
 		log.Println("[ERR]", err)
 		return
 	}
-	defer resp.Body.Close()
-
-	if rep, err = ioutil.ReadAll(resp.Body); err != nil {
-		log.Println("[ERR]", err)
-		return
-	}
 	log.Printf("[DBG]\n  🡳  %s\n", rep)
 
 	if resp.StatusCode == 400 {
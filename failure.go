@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// failureKind classifies why a request got no response.
+// SUT crashes usually show up as connection_refused, connection_reset
+// or malformed_response while dns & tls_handshake point at the setup.
+type failureKind string
+
+const (
+	failureDNS               failureKind = "dns"
+	failureConnectionRefused failureKind = "connection_refused"
+	failureConnectionReset   failureKind = "connection_reset"
+	failureTLSHandshake      failureKind = "tls_handshake"
+	failureTimeout           failureKind = "timeout"
+	failureMalformedResponse failureKind = "malformed_response"
+	failureBodyTooLarge      failureKind = "body_too_large"
+	failureOther             failureKind = "other"
+)
+
+// maxBodySize is the most bytes of a response body read before giving up
+var maxBodySize int64 = 64 << 20
+
+var errBodyTooLarge = errors.New("response body too large")
+
+// readBody reads the whole response body so that failures happening
+// while it is received get classified too.
+// The body is kept in memory only when asked to.
+func readBody(resp *http.Response, keep bool) (err error) {
+	defer resp.Body.Close()
+	limited := io.LimitReader(resp.Body, maxBodySize+1)
+
+	var n int64
+	var body []byte
+	if keep {
+		body, err = ioutil.ReadAll(limited)
+		n = int64(len(body))
+	} else {
+		n, err = io.Copy(ioutil.Discard, limited)
+	}
+	if err != nil {
+		return
+	}
+	if n > maxBodySize {
+		err = errBodyTooLarge
+		return
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return
+}
+
+// classifyFailure looks past the errors net/http & net wrap around the cause
+func classifyFailure(err error) failureKind {
+	cause := err
+	for unwrapped := false; !unwrapped; {
+		switch e := cause.(type) {
+		case *url.Error:
+			cause = e.Err
+		case *net.OpError:
+			cause = e.Err
+		case *os.SyscallError:
+			cause = e.Err
+		default:
+			unwrapped = true
+		}
+	}
+
+	switch e := cause.(type) {
+	case *net.DNSError:
+		return failureDNS
+	case syscall.Errno:
+		switch e {
+		case syscall.ECONNREFUSED, syscall.ENOENT:
+			return failureConnectionRefused
+		case syscall.ECONNRESET, syscall.ECONNABORTED, syscall.EPIPE:
+			return failureConnectionReset
+		}
+	case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError,
+		tls.RecordHeaderError:
+		return failureTLSHandshake
+	}
+	if isTimeout(err) {
+		return failureTimeout
+	}
+
+	switch cause {
+	case errBodyTooLarge:
+		return failureBodyTooLarge
+	case io.EOF, io.ErrUnexpectedEOF:
+		// The SUT hung up before responding in full
+		return failureConnectionReset
+	}
+
+	msg := cause.Error()
+	switch {
+	case strings.HasPrefix(msg, "tls: "), strings.Contains(msg, "x509: "):
+		return failureTLSHandshake
+	case strings.Contains(msg, "malformed"), strings.Contains(msg, "server response headers exceeded"):
+		return failureMalformedResponse
+	case strings.HasPrefix(msg, "gzip: "), strings.HasPrefix(msg, "zlib: "),
+		strings.HasPrefix(msg, "flate: "), strings.HasPrefix(msg, "brotli: "):
+		// Body does not match its Content-Encoding
+		return failureMalformedResponse
+	case strings.Contains(msg, "connection refused"):
+		return failureConnectionRefused
+	case strings.Contains(msg, "connection reset"), strings.Contains(msg, "broken pipe"):
+		return failureConnectionReset
+	}
+	return failureOther
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// unresolvable fails every DNS lookup without reaching the network
+var unresolvable = &net.Resolver{
+	PreferGo: true,
+	Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("no DNS in tests")
+	},
+}
+
+func failureOf(t *testing.T, URL string, handler http.HandlerFunc, timeout time.Duration) failureKind {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{Resolver: unresolvable}).DialContext,
+		},
+		Timeout: timeout,
+	}
+	if handler != nil {
+		server := httptest.NewServer(handler)
+		defer server.Close()
+		URL = server.URL
+	}
+
+	resp, err := client.Get(URL)
+	if err == nil {
+		err = readBody(resp, false)
+	}
+	if err == nil {
+		t.Fatalf("expected %s to fail", URL)
+	}
+	return classifyFailure(err)
+}
+
+func hijacked(t *testing.T, then func(conn net.Conn)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		then(conn)
+	}
+}
+
+func TestClassifyFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedURL := "http://" + listener.Addr().String()
+	listener.Close()
+
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(sutOK))
+	defer tlsServer.Close()
+
+	oldMaxBodySize := maxBodySize
+	maxBodySize = 8
+	defer func() { maxBodySize = oldMaxBodySize }()
+
+	// Generous so that a slow machine does not turn other failures into timeouts
+	const timeout = 10 * time.Second
+	for expected, run := range map[failureKind]func() failureKind{
+		failureDNS: func() failureKind {
+			return failureOf(t, "http://monkey.invalid", nil, timeout)
+		},
+		failureConnectionRefused: func() failureKind {
+			return failureOf(t, closedURL, nil, timeout)
+		},
+		failureConnectionReset: func() failureKind {
+			return failureOf(t, "", hijacked(t, func(conn net.Conn) {}), timeout)
+		},
+		failureTLSHandshake: func() failureKind {
+			return failureOf(t, tlsServer.URL, nil, timeout)
+		},
+		failureTimeout: func() failureKind {
+			return failureOf(t, "", func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			}, 100*time.Millisecond)
+		},
+		failureMalformedResponse: func() failureKind {
+			return failureOf(t, "", hijacked(t, func(conn net.Conn) {
+				conn.Write([]byte("NOT HTTP\r\n\r\n"))
+			}), timeout)
+		},
+		failureBodyTooLarge: func() failureKind {
+			return failureOf(t, "", func(w http.ResponseWriter, r *http.Request) {
+				w.Write(bytes.Repeat([]byte("x"), 9))
+			}, timeout)
+		},
+	} {
+		if got := run(); got != expected {
+			t.Errorf("expected %s, got %s", expected, got)
+		}
+	}
+}
@@ -1,34 +1,486 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
-	"github.com/cardigann/harhar"
+	"github.com/dsnet/compress/brotli"
+	"github.com/sebcat/har"
 )
 
+// maxRecordedBody is the most bytes of a response body that get recorded.
+// Longer bodies are still read through, but their HAR content is truncated.
+var maxRecordedBody int64 = 1 << 20
+
 var (
 	clientReq    *http.Client
-	harCollector *harhar.Recorder
+	harCollector *harRecorder
 )
 
-type harEntry *harhar.Entry
+type harEntry *harLogEntry
+
+// harLogEntry & the following types are HAR 1.2 entries
+type harLogEntry struct {
+	StartedDateTime string        `json:"startedDateTime"`
+	Time            float64       `json:"time"`
+	Request         harLogRequest `json:"request"`
+	Response        harResponse   `json:"response"`
+	Cache           struct{}      `json:"cache"`
+	Timings         harTimings    `json:"timings"`
+	// Wire points at the exact bytes exchanged, when captured
+	Wire *harWire `json:"_wire,omitempty"`
+}
+
+type harLogRequest struct {
+	Method      string        `json:"method"`
+	URL         string        `json:"url"`
+	HTTPVersion string        `json:"httpVersion"`
+	Cookies     []harCookie   `json:"cookies"`
+	Headers     []har.NVP     `json:"headers"`
+	QueryString []har.NVP     `json:"queryString"`
+	PostData    *har.PostData `json:"postData,omitempty"`
+	HeadersSize int           `json:"headersSize"`
+	BodySize    int64         `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []harCookie `json:"cookies"`
+	Headers     []har.NVP   `json:"headers"`
+	Content     harContent  `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	// BodySize counts bytes received, before any decoding
+	BodySize int64 `json:"bodySize"`
+}
+
+type harContent struct {
+	// Size counts decoded bytes
+	Size int64 `json:"size"`
+	// Compression counts bytes saved by Content-Encoding
+	Compression int64  `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	// Encoding is base64 for bodies that are not text
+	Encoding string `json:"encoding,omitempty"`
+	// Comment tells when Text is truncated
+	Comment string `json:"comment,omitempty"`
+}
+
+type harCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+// harTimings are in milliseconds, -1 meaning does not apply.
+// Connect includes SSL.
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harTrace notes when each step of a request happens.
+// Dialing happens on other goroutines.
+type harTrace struct {
+	sync.Mutex
+	start                     time.Time
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	gotConn, wrote, firstByte time.Time
+	reused                    bool
+}
+
+func newHARTrace(start time.Time) *harTrace {
+	return &harTrace{start: start}
+}
+
+func (trace *harTrace) clientTrace() *httptrace.ClientTrace {
+	at := func(t *time.Time) {
+		trace.Lock()
+		if t.IsZero() {
+			*t = time.Now()
+		}
+		trace.Unlock()
+	}
+	return &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { at(&trace.dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { at(&trace.dnsDone) },
+		ConnectStart:      func(string, string) { at(&trace.connectStart) },
+		ConnectDone:       func(string, string, error) { at(&trace.connectDone) },
+		TLSHandshakeStart: func() { at(&trace.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { at(&trace.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			at(&trace.gotConn)
+			trace.Lock()
+			trace.reused = info.Reused
+			trace.Unlock()
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { at(&trace.wrote) },
+		GotFirstResponseByte: func() { at(&trace.firstByte) },
+	}
+}
+
+// timings of a request that got its whole response at end
+func (trace *harTrace) timings(end time.Time) (timings harTimings) {
+	trace.Lock()
+	defer trace.Unlock()
+
+	span := func(from, to time.Time) float64 {
+		if from.IsZero() || to.IsZero() || to.Before(from) {
+			return -1
+		}
+		return float64(to.Sub(from)) / float64(time.Millisecond)
+	}
+
+	timings.DNS, timings.Connect, timings.SSL = -1, -1, -1
+	blockedUntil := trace.gotConn
+	if !trace.reused {
+		timings.DNS = span(trace.dnsStart, trace.dnsDone)
+		connectDone := trace.connectDone
+		if !trace.tlsDone.IsZero() {
+			connectDone = trace.tlsDone
+		}
+		timings.Connect = span(trace.connectStart, connectDone)
+		timings.SSL = span(trace.tlsStart, trace.tlsDone)
+		for _, first := range []time.Time{trace.connectStart, trace.dnsStart} {
+			if !first.IsZero() && first.Before(blockedUntil) {
+				blockedUntil = first
+			}
+		}
+	}
+	timings.Blocked = span(trace.start, blockedUntil)
+	timings.Send = nonNegative(span(trace.gotConn, trace.wrote))
+	timings.Wait = nonNegative(span(trace.wrote, trace.firstByte))
+	timings.Receive = nonNegative(span(trace.firstByte, end))
+	return
+}
+
+// total of the timings that apply, SSL being part of Connect
+func (timings *harTimings) total() (total float64) {
+	for _, timing := range []float64{timings.Blocked, timings.DNS, timings.Connect,
+		timings.Send, timings.Wait, timings.Receive} {
+		if timing > 0 {
+			total += timing
+		}
+	}
+	return
+}
+
+// nonNegative as send, wait & receive are required
+func nonNegative(timing float64) float64 {
+	if timing < 0 {
+		return 0
+	}
+	return timing
+}
+
+// harRecorder records what goes through its RoundTripper as HAR entries
+type harRecorder struct {
+	http.RoundTripper
+	entries []*harLogEntry
+	wire    *wireCapture
+}
 
-func newHARTransport() {
-	harCollector = harhar.NewRecorder()
-	clientReq = &http.Client{Transport: harCollector}
+// newHARTransport is called once per test, with the test's first request.
+// The optional cookie jar thus only lives for the duration of a test.
+func newHARTransport(cfg *ymlCfg, target *url.URL) {
+	harCollector = &harRecorder{RoundTripper: targetTransport(cfg, target)}
+	harCollector.wire = cfg.Wire
+	clientReq = &http.Client{
+		Transport: harCollector,
+		Timeout:   cfg.Timeouts.Request,
+	}
+	if cfg.CookieJar {
+		// Sent cookies are set on requests before they reach harCollector
+		clientReq.Jar, _ = cookiejar.New(nil)
+	}
 }
 
 func isHARReady() bool {
 	return clientReq != nil
 }
 
+// lastHAR is complete once the response body has been closed
 func lastHAR() harEntry {
-	all := harCollector.HAR.Log.Entries
-	//FIXME: even less data actually needs to be sent
-	return &all[len(all)-1]
+	all := harCollector.entries
+	return all[len(all)-1]
 }
 
 func clearHAR() {
 	harCollector = nil
 	clientReq = nil
 }
+
+func (rec *harRecorder) RoundTrip(r *http.Request) (resp *http.Response, err error) {
+	start := time.Now()
+	entry := &harLogEntry{StartedDateTime: start.Format(time.RFC3339Nano)}
+	if err = entry.recordRequest(r); err != nil {
+		return
+	}
+
+	if rec.wire != nil {
+		rec.wire.start()
+	}
+	trace := newHARTrace(start)
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), trace.clientTrace()))
+	if resp, err = rec.RoundTripper.RoundTrip(r); err != nil {
+		return
+	}
+	entry.recordResponse(resp)
+	resp.Body = newHARBody(entry, resp, trace, rec.wire)
+	rec.entries = append(rec.entries, entry)
+	return
+}
+
+func (entry *harLogEntry) recordRequest(r *http.Request) (err error) {
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	entry.Request = harLogRequest{
+		Method:      r.Method,
+		URL:         r.URL.String(),
+		HTTPVersion: r.Proto,
+		Cookies:     harCookies(r.Cookies()),
+		// Headers are sorted, as sent. The wire capture has them as is.
+		Headers:     append([]har.NVP{{Name: "Host", Value: host}}, harNVPs(r.Header)...),
+		QueryString: harNVPs(r.URL.Query()),
+		HeadersSize: -1,
+	}
+
+	if r.Body == nil {
+		return
+	}
+	var body []byte
+	if body, err = ioutil.ReadAll(r.Body); err != nil {
+		return
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	entry.Request.BodySize = int64(len(body))
+	entry.Request.PostData = &har.PostData{
+		MimeType: r.Header.Get("Content-Type"),
+		Text:     string(body),
+	}
+	return
+}
+
+func (entry *harLogEntry) recordResponse(resp *http.Response) {
+	// The protocol actually used
+	entry.Request.HTTPVersion = resp.Proto
+	entry.Response = harResponse{
+		Status:      resp.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(resp.Status, fmt.Sprint(resp.StatusCode))),
+		HTTPVersion: resp.Proto,
+		Cookies:     harCookies(resp.Cookies()),
+		Headers:     harNVPs(resp.Header),
+		Content:     harContent{MimeType: resp.Header.Get("Content-Type")},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+	}
+}
+
+func harNVPs(values map[string][]string) (nvps []har.NVP) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	nvps = []har.NVP{}
+	for _, name := range names {
+		for _, value := range values[name] {
+			nvps = append(nvps, har.NVP{Name: name, Value: value})
+		}
+	}
+	return
+}
+
+func harCookies(cookies []*http.Cookie) (harCookies []harCookie) {
+	harCookies = []harCookie{}
+	for _, cookie := range cookies {
+		harCookies = append(harCookies, harCookie{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Path:     cookie.Path,
+			Domain:   cookie.Domain,
+			HTTPOnly: cookie.HttpOnly,
+			Secure:   cookie.Secure,
+		})
+	}
+	return
+}
+
+// harBody decodes the response body as it is read, recording
+// up to maxRecordedBody bytes of it into its entry.
+type harBody struct {
+	entry    *harLogEntry
+	raw      io.ReadCloser
+	received int64
+	encoding string
+	decoded  io.Reader
+	recorded bytes.Buffer
+	size     int64
+	trace    *harTrace
+	wire     *wireCapture
+	done     bool
+}
+
+func newHARBody(entry *harLogEntry, resp *http.Response, trace *harTrace, wire *wireCapture) *harBody {
+	body := &harBody{
+		entry:    entry,
+		raw:      resp.Body,
+		encoding: strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))),
+		trace:    trace,
+		wire:     wire,
+	}
+	if body.decodes() {
+		// Bodies are read decoded, headers are left as received
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+	}
+	return body
+}
+
+func (body *harBody) decodes() bool {
+	switch body.encoding {
+	case "gzip", "x-gzip", "deflate", "br":
+		return true
+	}
+	return false
+}
+
+func (body *harBody) Read(p []byte) (n int, err error) {
+	if body.decoded == nil {
+		if err = body.newDecoder(); err != nil {
+			body.finish()
+			return
+		}
+	}
+
+	n, err = body.decoded.Read(p)
+	body.size += int64(n)
+	if room := maxRecordedBody - int64(body.recorded.Len()); room > 0 {
+		if int64(n) < room {
+			room = int64(n)
+		}
+		body.recorded.Write(p[:room])
+	}
+	if err != nil {
+		body.finish()
+	}
+	return
+}
+
+func (body *harBody) Write(p []byte) (int, error) {
+	body.received += int64(len(p))
+	return len(p), nil
+}
+
+func (body *harBody) newDecoder() (err error) {
+	raw := io.TeeReader(body.raw, body)
+	switch body.encoding {
+	case "gzip", "x-gzip":
+		body.decoded, err = gzip.NewReader(raw)
+	case "deflate":
+		body.decoded, err = zlib.NewReader(raw)
+	case "br":
+		body.decoded, err = brotli.NewReader(raw, nil)
+	default:
+		body.decoded = raw
+	}
+	return
+}
+
+func (body *harBody) Close() error {
+	body.finish()
+	return body.raw.Close()
+}
+
+// finish fills in the entry's content, once
+func (body *harBody) finish() {
+	if body.done {
+		return
+	}
+	body.done = true
+
+	entry := body.entry
+	entry.Timings = body.trace.timings(time.Now())
+	entry.Time = entry.Timings.total()
+	if body.wire != nil {
+		label := fmt.Sprintf("%d.%d %s %s", lastLane.T, lastLane.R,
+			entry.Request.Method, entry.Request.URL)
+		entry.Wire = body.wire.flush(label)
+	}
+	entry.Response.BodySize = body.received
+	content := &entry.Response.Content
+	content.Size = body.size
+	if body.decodes() {
+		content.Compression = body.size - body.received
+	}
+
+	recorded := body.recorded.Bytes()
+	truncated := int64(len(recorded)) < body.size
+	if truncated {
+		content.Comment = fmt.Sprintf("truncated to %d of %d bytes", len(recorded), body.size)
+		// Do not leave half a character behind
+		for cut := len(recorded); cut > 0 && cut > len(recorded)-utf8.UTFMax; cut-- {
+			if utf8.Valid(recorded[:cut]) {
+				recorded = recorded[:cut]
+				break
+			}
+		}
+	}
+
+	if isTextual(content.MimeType) && utf8.Valid(recorded) {
+		content.Text = string(recorded)
+		if truncated {
+			content.Text += truncatedMarker
+		}
+	} else {
+		content.Text = base64.StdEncoding.EncodeToString(body.recorded.Bytes())
+		content.Encoding = "base64"
+	}
+}
+
+// isTextual tells whether a MIME type describes text.
+// Bodies of unknown type are considered text if they are valid UTF-8.
+func isTextual(mimeType string) bool {
+	mimeType = strings.ToLower(mimeType)
+	if mimeType == "" || strings.HasPrefix(mimeType, "text/") {
+		return true
+	}
+	for _, textual := range []string{"json", "xml", "javascript", "yaml", "x-www-form-urlencoded"} {
+		if strings.Contains(mimeType, textual) {
+			return true
+		}
+	}
+	return false
+}
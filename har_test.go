@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func recordedEntry(t *testing.T, handler http.HandlerFunc) (body []byte, entry harEntry) {
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	rec := &harRecorder{RoundTripper: &http.Transport{DisableCompression: true}}
+	client := &http.Client{Transport: rec}
+	r, err := http.NewRequest(http.MethodPost, server.URL+"/?q=1", strings.NewReader(`{"a":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	resp, err := client.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if len(rec.entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(rec.entries))
+	}
+	entry = rec.entries[0]
+	if entry.Request.PostData == nil || entry.Request.PostData.Text != `{"a":1}` {
+		t.Errorf("unexpected request body %+v", entry.Request.PostData)
+	}
+	return
+}
+
+func TestHARDecodesContentEncoding(t *testing.T) {
+	const text = `{"items": ["abcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabc"]}`
+	// text compressed with brotli
+	const brText = "\x1b\x3e\x00\x00\x04\x6a\x72\xa4\xbf\x13\x7c\xd2\x5f\x50\x09\xb6\xf2\x12\x4d\xfc\x29\x42\x75\x14\x46\x77\x58\xa1\x67\x45\x3d"
+	for encoding, newWriter := range map[string]func(io.Writer) io.WriteCloser{
+		"gzip":    func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"deflate": func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+		"br":      nil,
+	} {
+		var encoded bytes.Buffer
+		if newWriter == nil {
+			// dsnet/compress has no brotli writer
+			encoded.WriteString(brText)
+		} else {
+			writer := newWriter(&encoded)
+			writer.Write([]byte(text))
+			writer.Close()
+		}
+
+		body, entry := recordedEntry(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", mimeJSON)
+			w.Header().Set("Content-Encoding", encoding)
+			w.Write(encoded.Bytes())
+		})
+
+		content := entry.Response.Content
+		if string(body) != text || content.Text != text || content.Encoding != "" {
+			t.Errorf("%s: expected decoded bodies, got %q and %+v", encoding, body, content)
+		}
+		if content.Size != int64(len(text)) || entry.Response.BodySize != int64(encoded.Len()) ||
+			content.Compression != content.Size-entry.Response.BodySize {
+			t.Errorf("%s: unexpected sizes %+v (body %d)", encoding, content, entry.Response.BodySize)
+		}
+	}
+}
+
+func TestHARBinaryBodiesAsBase64(t *testing.T) {
+	binary := []byte{0x89, 'P', 'N', 'G', 0, 0xff, 0xfe}
+	_, entry := recordedEntry(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(binary)
+	})
+
+	content := entry.Response.Content
+	if content.Encoding != "base64" || content.Text != base64.StdEncoding.EncodeToString(binary) {
+		t.Errorf("expected base64, got %+v", content)
+	}
+}
+
+func TestHARTruncatesLargeBodies(t *testing.T) {
+	oldMaxRecordedBody := maxRecordedBody
+	maxRecordedBody = 5
+	defer func() { maxRecordedBody = oldMaxRecordedBody }()
+
+	body, entry := recordedEntry(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("abcdéfgh"))
+	})
+
+	content := entry.Response.Content
+	if string(body) != "abcdéfgh" {
+		t.Errorf("expected the body to be read through, got %q", body)
+	}
+	if content.Text != "abcd"+truncatedMarker || content.Size != 9 || content.Comment == "" {
+		t.Errorf("expected a truncated text, got %+v", content)
+	}
+}
+
+func TestHARTimings(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		sutOK(w, r)
+	}))
+	defer server.Close()
+
+	rec := &harRecorder{RoundTripper: server.Client().Transport}
+	client := &http.Client{Transport: rec}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	fresh, reused := rec.entries[0].Timings, rec.entries[1].Timings
+	if fresh.Connect < 0 || fresh.SSL < 0 || fresh.SSL > fresh.Connect || fresh.DNS != -1 {
+		t.Errorf("unexpected timings for a new connection: %+v", fresh)
+	}
+	if reused.Connect != -1 || reused.SSL != -1 || reused.DNS != -1 {
+		t.Errorf("unexpected timings for a reused connection: %+v", reused)
+	}
+	for _, timings := range []harTimings{fresh, reused} {
+		if timings.Wait < 20 || timings.Send < 0 || timings.Receive < 0 || timings.Blocked < 0 {
+			t.Errorf("unexpected timings: %+v", timings)
+		}
+	}
+	if entry := rec.entries[1]; entry.Time != entry.Timings.total() || entry.Time < entry.Timings.Wait {
+		t.Errorf("unexpected time %f for %+v", entry.Time, entry.Timings)
+	}
+}
+
+func TestHARRecordsHTTPVersion(t *testing.T) {
+	server := httptest.NewServer(h2cHandler(http.HandlerFunc(sutOK)))
+	defer server.Close()
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { clientReq, harCollector = nil, nil }()
+
+	for _, mode := range []string{http2H2C, http2Auto} {
+		newHARTransport(&ymlCfg{HTTP2: mode}, target)
+		resp, err := clientReq.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = readBody(resp, false); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]string{http2H2C: "HTTP/2.0", http2Auto: "HTTP/1.1"}[mode]
+		entry := harCollector.entries[0]
+		if entry.Request.HTTPVersion != expected || entry.Response.HTTPVersion != expected {
+			t.Errorf("expected %s with %s, got request %s and response %s",
+				expected, mode, entry.Request.HTTPVersion, entry.Response.HTTPVersion)
+		}
+	}
+}
+
+// h2cHandler serves HTTP/2 to clients that talk it from the start,
+// the connection preface being read by net/http as a PRI request.
+func h2cHandler(handler http.Handler) http.Handler {
+	server := &http2.Server{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PRI" || r.URL.Path != "*" || r.ProtoMajor != 2 {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		// Give back the preface to http2
+		preface := make([]byte, len("SM\r\n\r\n"))
+		if _, err = io.ReadFull(rw, preface); err != nil {
+			conn.Close()
+			return
+		}
+		server.ServeConn(&h2cConn{
+			Conn:   conn,
+			Reader: io.MultiReader(strings.NewReader(http2.ClientPreface), rw),
+		}, &http2.ServeConnOpts{Handler: handler})
+	})
+}
+
+type h2cConn struct {
+	net.Conn
+	io.Reader
+}
+
+func (conn *h2cConn) Read(p []byte) (int, error) { return conn.Reader.Read(p) }
+
+func TestCookieJarIsPerTest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie("session"); err != nil {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "42"})
+		}
+	}))
+	defer server.Close()
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clearHAR()
+
+	cfg := &ymlCfg{CookieJar: true}
+	for test := 0; test < 2; test++ {
+		clearHAR()
+		newHARTransport(cfg, target)
+		for _, expected := range []int{0, 1} {
+			resp, err := clientReq.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := len(lastHAR().Request.Cookies); got != expected {
+				t.Errorf("test #%d: expected %d cookies, got %d", test, expected, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// envWorker holds the index of the worker a process runs as, starting at 1.
+// Scripts see it too, so that each worker can start its own SUT instance.
+const envWorker = "MONKEY_WORKER"
+
+// workerCommand builds the command running one worker with args
+var workerCommand = func(args []string) (cmd *exec.Cmd, err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Println("[ERR]", err)
+		return
+	}
+	cmd = exec.Command(exe, args...)
+	return
+}
+
+// workerOutput serializes workers' lines of output
+var workerOutput sync.Mutex
+
+// workerSuffix tells apart the files of concurrent workers
+func workerSuffix() string {
+	if worker := os.Getenv(envWorker); worker != "" {
+		return "_w" + worker
+	}
+	return ""
+}
+
+func parseJobs(value interface{}) (jobs int, err error) {
+	str, _ := value.(string)
+	if jobs, err = strconv.Atoi(str); err != nil || jobs < 1 {
+		err = fmt.Errorf("--jobs expects a positive number, got %q", str)
+		log.Println("[ERR]", err)
+		fmt.Println(err)
+	}
+	return
+}
+
+// doJobs runs fuzz in as many worker processes, each with its own
+// server session, and exits with the worst of their exit codes.
+func doJobs(jobs int) int {
+	fmt.Printf("Running %d workers\n", jobs)
+	codes := make([]int, jobs)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = runWorker(i + 1)
+		}(i)
+	}
+	wg.Wait()
+
+	code := 0
+	for i, workerCode := range codes {
+		log.Printf("[NFO] worker %d exited with %d\n", i+1, workerCode)
+		switch {
+		case workerCode == 6:
+			fmt.Printf("Worker %d found a bug\n", i+1)
+			if code == 0 {
+				code = 6
+			}
+		case workerCode != 0 && (code == 0 || code == 6):
+			code = workerCode
+		}
+	}
+	return code
+}
+
+func runWorker(worker int) int {
+	cmd, err := workerCommand(workerArgs(os.Args[1:], worker))
+	if err != nil {
+		return retryOrReport()
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, envWorker+"="+strconv.Itoa(worker))
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Println("[ERR]", err)
+		return retryOrReport()
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		log.Println("[ERR]", err)
+		return retryOrReport()
+	}
+
+	log.Printf("[NFO] starting worker %d: %v\n", worker, cmd.Args)
+	if err = cmd.Start(); err != nil {
+		log.Println("[ERR]", err)
+		fmt.Printf("Could not start worker %d\n", worker)
+		return retryOrReport()
+	}
+
+	prefix := fmt.Sprintf("[w%d] ", worker)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go prefixLines(&wg, os.Stdout, stdout, prefix)
+	go prefixLines(&wg, os.Stderr, stderr, prefix)
+	wg.Wait()
+
+	if err = cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				return status.ExitStatus()
+			}
+		}
+		log.Println("[ERR]", err)
+		return retryOrReport()
+	}
+	return 0
+}
+
+func prefixLines(wg *sync.WaitGroup, w io.Writer, r io.Reader, prefix string) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		workerOutput.Lock()
+		fmt.Fprintln(w, prefix+scanner.Text())
+		workerOutput.Unlock()
+	}
+}
+
+// workerArgs drops --jobs and gives each worker its own recording
+func workerArgs(args []string, worker int) (workerArgs []string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--jobs" && i+1 < len(args):
+			i++
+		case strings.HasPrefix(arg, "--jobs="):
+		case arg == "--record" && i+1 < len(args):
+			i++
+			workerArgs = append(workerArgs, arg, workerPath(args[i], worker))
+		case strings.HasPrefix(arg, "--record="):
+			path := strings.TrimPrefix(arg, "--record=")
+			workerArgs = append(workerArgs, "--record="+workerPath(path, worker))
+		default:
+			workerArgs = append(workerArgs, arg)
+		}
+	}
+	return
+}
+
+// workerPath turns session.json into session.w1.json
+func workerPath(path string, worker int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.w%d%s", strings.TrimSuffix(path, ext), worker, ext)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const envTestWorkerArgs = "MONKEY_TEST_WORKER_ARGS"
+
+// TestWorkerProcess is what workers run as during tests
+func TestWorkerProcess(t *testing.T) {
+	args := os.Getenv(envTestWorkerArgs)
+	if args == "" {
+		t.Skip("only run as a worker")
+	}
+
+	os.Args = append([]string{binName}, strings.Split(args, "\n")...)
+	os.Exit(actualMain())
+}
+
+func TestWorkerArgs(t *testing.T) {
+	args := []string{"--api-root=URL", "fuzz", "--jobs", "3", "--record=run.json", "--resume"}
+	expected := []string{"--api-root=URL", "fuzz", "--record=run.w2.json", "--resume"}
+	if got := workerArgs(args, 2); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	args = []string{"fuzz", "--jobs=2", "--record", "run"}
+	expected = []string{"fuzz", "--record", "run.w1"}
+	if got := workerArgs(args, 1); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestMockServerJobs(t *testing.T) {
+	oldWorkerCommand, testBinary := workerCommand, os.Args[0]
+	defer func() { workerCommand = oldWorkerCommand }()
+	workerCommand = func(args []string) (*exec.Cmd, error) {
+		cmd := exec.Command(testBinary, "-test.run=^TestWorkerProcess$")
+		cmd.Env = append(os.Environ(), envTestWorkerArgs+"="+strings.Join(args, "\n"))
+		return cmd, nil
+	}
+
+	f := newMockFixture(t, mockRun{
+		campaign: defaultMockCampaign(),
+		sut:      sutOK,
+		yml:      "start:\n  - echo $" + envWorker + " >>workers.txt\n",
+	})
+	defer f.close()
+
+	if code := f.fuzz("--jobs=2"); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+
+	if len(f.mock.sessions) != 2 {
+		t.Errorf("expected 2 sessions, got %d", len(f.mock.sessions))
+	}
+	if hits := atomic.LoadInt64(&f.hits); f.mock.Reqs != 12 || hits != 12 {
+		t.Errorf("expected 12 requests, got %d (SUT saw %d)", f.mock.Reqs, hits)
+	}
+
+	data, err := ioutil.ReadFile("workers.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workers := strings.Fields(string(data))
+	sort.Strings(workers)
+	if !reflect.DeepEqual(workers, []string{"1", "2"}) {
+		t.Errorf("expected start to run once per worker, got %q", workers)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// latencies holds response times in μs, per endpoint, for the current process
+var latencies = make(map[string][]uint64)
+
+// idSegment matches path segments that most likely are identifiers:
+// numbers, UUIDs & long hexadecimal strings.
+var idSegment = regexp.MustCompile(`^([0-9]+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{16,})$`)
+
+// pathTemplate guesses the templated path a request was generated from,
+// replacing identifiers with {id}.
+func pathTemplate(rawURL string) string {
+	URL, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	segments := strings.Split(URL.Path, "/")
+	for i, segment := range segments {
+		if idSegment.MatchString(segment) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func recordLatency(method, rawURL string, us uint64) {
+	endpoint := method + " " + pathTemplate(rawURL)
+	latencies[endpoint] = append(latencies[endpoint], us)
+}
+
+// percentile uses the nearest-rank method on sorted values
+func percentile(sorted []uint64, p int) uint64 {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func printLatencies() {
+	if len(latencies) == 0 {
+		return
+	}
+
+	endpoints := make([]string, 0, len(latencies))
+	width := len("Latencies (ms)")
+	for endpoint := range latencies {
+		endpoints = append(endpoints, endpoint)
+		if len(endpoint) > width {
+			width = len(endpoint)
+		}
+	}
+	sort.Strings(endpoints)
+
+	ms := func(us uint64) float64 { return float64(us) / 1000 }
+	fmt.Printf("%-*s %9s %9s %9s %9s %7s\n", width, "Latencies (ms)", "p50", "p95", "p99", "max", "count")
+	for _, endpoint := range endpoints {
+		sorted := append([]uint64(nil), latencies[endpoint]...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		fmt.Printf("%-*s %9.1f %9.1f %9.1f %9.1f %7d\n", width, endpoint,
+			ms(percentile(sorted, 50)), ms(percentile(sorted, 95)), ms(percentile(sorted, 99)),
+			ms(sorted[len(sorted)-1]), len(sorted))
+	}
+}
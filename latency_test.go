@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestPathTemplate(t *testing.T) {
+	for rawURL, expected := range map[string]string{
+		"http://localhost/":                                                "/",
+		"http://localhost/api/v1/items":                                    "/api/v1/items",
+		"http://localhost/items/42?x=1":                                    "/items/{id}",
+		"http://localhost/items/6ba7b810-9dad-11d1-80b4-00c04fd430c8/tags": "/items/{id}/tags",
+		"http://localhost/blobs/0123456789abcdef0123":                      "/blobs/{id}",
+		"http://localhost/users/me":                                        "/users/me",
+	} {
+		if got := pathTemplate(rawURL); got != expected {
+			t.Errorf("%s: expected %s, got %s", rawURL, expected, got)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := make([]uint64, 200)
+	for i := range sorted {
+		sorted[i] = uint64(i + 1)
+	}
+	for p, expected := range map[int]uint64{50: 100, 95: 190, 99: 198, 100: 200} {
+		if got := percentile(sorted, p); got != expected {
+			t.Errorf("p%d: expected %d, got %d", p, expected, got)
+		}
+	}
+	if got := percentile([]uint64{7}, 50); got != 7 {
+		t.Errorf("expected 7, got %d", got)
+	}
+}
+
+func TestRecordLatencyPerEndpoint(t *testing.T) {
+	old := latencies
+	latencies = make(map[string][]uint64)
+	defer func() { latencies = old }()
+
+	recordLatency("GET", "http://localhost/items/1", 10)
+	recordLatency("GET", "http://localhost/items/2?x=1", 20)
+	recordLatency("DELETE", "http://localhost/items/2", 30)
+	for endpoint, expected := range map[string]int{"GET /items/{id}": 2, "DELETE /items/{id}": 1} {
+		if got := len(latencies[endpoint]); got != expected {
+			t.Errorf("%s: expected %d latencies, got %d", endpoint, expected, got)
+		}
+	}
+}
@@ -27,6 +27,7 @@ var (
 	apiRoot     string
 	initURL     string
 	nextURL     string
+	streamURL   string
 	lintURL     string
 	clientUtils = &http.Client{}
 )
@@ -35,15 +36,15 @@ func init() {
 	log.SetFlags(log.Lshortfile | log.Lmicroseconds | log.LUTC)
 
 	if binVersion == "0.0.0" {
-		apiRoot = "http://fuzz.dev.fuzzymonkey.co/1"
-		lintURL = "http://lint.dev.fuzzymonkey.co/1/blob"
+		apiRoot = "https://fuzz.dev.fuzzymonkey.co/1"
+		lintURL = "https://lint.dev.fuzzymonkey.co/1/blob"
 	} else {
-		//FIXME: use HTTPS
-		apiRoot = "http://fuzz.fuzzymonkey.co/1"
-		lintURL = "http://lint.fuzzymonkey.co/1/blob"
+		apiRoot = "https://fuzz.fuzzymonkey.co/1"
+		lintURL = "https://lint.fuzzymonkey.co/1/blob"
 	}
 	initURL = apiRoot + "/init"
 	nextURL = apiRoot + "/next"
+	streamURL = apiRoot + "/stream"
 
 	loadSchemas()
 }
@@ -53,31 +54,48 @@ func main() {
 }
 
 func usage() (docopt.Opts, error) {
-	usage := binName + "\tv" + binVersion + "\t" + binDescribe + "\t" + runtime.Version() + `
+	// Not OptionsFirst: commands take options, as in fuzz --resume
+	parser := &docopt.Parser{HelpHandler: docopt.PrintHelpOnly}
+	return parser.ParseArgs(usageDoc(), os.Args[1:], binTitle)
+}
+
+func usageDoc() string {
+	return binName + "\tv" + binVersion + "\t" + binDescribe + "\t" + runtime.Version() + `
 
 Usage:
-  ` + binName + ` [-vvv] fuzz
-  ` + binName + ` [-vvv] lint
+  ` + binName + ` [-vvv] [--api-root=URL] fuzz [--resume] [--record=FILE] [--jobs=N]
+  ` + binName + ` [-vvv] replay [--bodies] <recording>
+  ` + binName + ` [-vvv] repro
+  ` + binName + ` [-vvv] [--api-root=URL] lint
+  ` + binName + ` [-vvv] mock-server [--listen=ADDR] [<campaign>]
   ` + binName + ` [-vvv] -h | --help
   ` + binName + ` [-vvv] -U | --update
   ` + binName + ` [-vvv] -V | --version
 
 Options:
-  -v, -vv, -vvv  Debug verbosity level
-  -h, --help     Show this screen
-  -U, --update   Ensures ` + binName + ` is latest
-  -V, --version  Show version
+  -v, -vv, -vvv   Debug verbosity level
+  -h, --help      Show this screen
+  -U, --update    Ensures ` + binName + ` is latest
+  -V, --version   Show version
+  --api-root=URL  Talk to this FuzzyMonkey API instead
+  --resume        Continue the interrupted run of this directory
+  --record=FILE   Save all commands received & replies sent to FILE
+  --jobs=N        Fuzz with N workers in parallel [default: 1]
+  --bodies        Replays also compare response bodies
+  --listen=ADDR   Where mock-server listens [default: ` + mockAddr + `]
+
+Environment:
+  FUZZYMONKEY_API_KEY      Your API key
+  FUZZYMONKEY_API_ROOT     Same as --api-root
+  FUZZYMONKEY_CA_FILE      Extra CA bundle (PEM) to trust
+  FUZZYMONKEY_CLIENT_CERT  Client certificate (PEM) to present
+  FUZZYMONKEY_CLIENT_KEY   Key of that client certificate (PEM)
+  MONKEY_WORKER            Index of the worker, set by --jobs
 
 Try:
      export FUZZYMONKEY_API_KEY=42
   ` + binName + ` --update
   ` + binName + ` fuzz`
-
-	parser := &docopt.Parser{
-		HelpHandler:  docopt.PrintHelpOnly,
-		OptionsFirst: true,
-	}
-	return parser.ParseArgs(usage, os.Args[1:], binTitle)
 }
 
 func actualMain() int {
@@ -109,17 +127,49 @@ func actualMain() int {
 	log.SetOutput(io.MultiWriter(logCatchall, logFiltered))
 	log.Println("[ERR] (not an error)", binTitle, logID(), args)
 
+	if clientUtils, err = newClientUtils(); err != nil {
+		return retryOrReport()
+	}
+
 	if args["--update"].(bool) {
 		return doUpdate()
 	}
 
+	if args["replay"].(bool) {
+		return doReplay(args["<recording>"].(string), args["--bodies"].(bool))
+	}
+
+	if args["repro"].(bool) {
+		return doRepro()
+	}
+
+	if args["mock-server"].(bool) {
+		campaign, _ := args["<campaign>"].(string)
+		return doMockServer(args["--listen"].(string), campaign)
+	}
+
+	maybeSetAPIRoot(args["--api-root"])
 	apiKey := os.Getenv(envAPIKey)
 	if args["lint"].(bool) {
 		return doLint(apiKey)
 	}
 
 	// if args["fuzz"].(bool)
-	return doFuzz(apiKey)
+	jobs, err := parseJobs(args["--jobs"])
+	if err != nil {
+		return 1
+	}
+	if jobs > 1 && os.Getenv(envWorker) == "" {
+		return doJobs(jobs)
+	}
+
+	if path, ok := args["--record"].(string); ok {
+		if err := startRecording(path); err != nil {
+			return 1
+		}
+		defer stopRecording()
+	}
+	return doFuzz(apiKey, args["--resume"].(bool))
 }
 
 func ensureDeleted(path string) {
@@ -168,7 +218,7 @@ func doLint(apiKey string) int {
 	return retryOrReport()
 }
 
-func doFuzz(apiKey string) int {
+func doFuzz(apiKey string, resume bool) int {
 	if _, err := os.Stat(shell()); os.IsNotExist(err) {
 		log.Printf("%s is required\n", shell())
 		return 5
@@ -183,7 +233,14 @@ func doFuzz(apiKey string) int {
 		return retryOrReport()
 	}
 
-	cfg, cmd, err := initDialogue(apiKey)
+	var cfg *ymlCfg
+	var cmd aCmd
+	var err error
+	if resume {
+		cfg, cmd, err = resumeDialogue()
+	} else {
+		cfg, cmd, err = initDialogue(apiKey)
+	}
 	if err != nil {
 		if _, ok := err.(*docsInvalidError); ok {
 			ensureDeleted(envID())
@@ -197,7 +254,13 @@ func doFuzz(apiKey string) int {
 
 	for {
 		if cmd.Kind() == kindDone {
+			closeStream()
+			closeWire(cfg)
 			ensureDeleted(envID())
+			ensureDeleted(sessionID())
+			if !cmd.(*doneCmd).Failure {
+				ensureDeleted(reproID())
+			}
 			return fuzzOutcome(cmd.(*doneCmd))
 		}
 
@@ -209,6 +272,8 @@ func doFuzz(apiKey string) int {
 
 func retryOrReportThenCleanup(cfg *ymlCfg, err error) int {
 	defer maybePostStop(cfg)
+	closeStream()
+	closeWire(cfg)
 	if hadExecError {
 		return 7
 	}
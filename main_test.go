@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/docopt/docopt-go"
+)
+
+// Invocations that did not need options after commands parse as they did
+// when options had to come first.
+func TestUsageOptionsFirstInvocations(t *testing.T) {
+	defer func(args []string) { os.Args = args }(os.Args)
+	optionsFirst := &docopt.Parser{HelpHandler: docopt.NoHelpHandler, OptionsFirst: true}
+	for _, argv := range [][]string{
+		{"fuzz"},
+		{"-vvv", "fuzz"},
+		{"--api-root=URL", "fuzz"},
+		{"-v", "lint"},
+		{"-vv", "-U"},
+		{"--update"},
+		{"replay", "run.json"},
+		{"repro"},
+		{"mock-server", "campaign.json"},
+	} {
+		expected, err := optionsFirst.ParseArgs(usageDoc(), argv, binTitle)
+		if err != nil {
+			t.Fatalf("%q: %s", argv, err)
+		}
+		os.Args = append([]string{binName}, argv...)
+		if got, err := usage(); err != nil || !reflect.DeepEqual(got, expected) {
+			t.Errorf("%q: expected %v, got %v (%v)", argv, expected, got, err)
+		}
+	}
+
+	os.Args = []string{binName, "fuzz", "--jobs=2", "-v"}
+	if got, err := usage(); err != nil || got["--jobs"] != "2" || got["-v"] != 1 {
+		t.Errorf("expected options after fuzz to parse, got %v (%v)", got, err)
+	}
+}
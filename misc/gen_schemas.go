@@ -15,6 +15,19 @@ func main() {
 		"schemaREQv1":     "misc/req_v1.json",
 		"schemaCMDv1":     "misc/cmd_req_v1.json",
 		"schemaCMDDonev1": "misc/cmd_rep_done_v1.json",
+		"schemaREQv2":     "misc/req_v2.json",
+		"schemaCMDv2":     "misc/cmd_req_v2.json",
+		"schemaCMDDonev2": "misc/cmd_rep_done_v2.json",
+		"schemaBATCHv2":   "misc/cmd_batch_v2.json",
+		// Replies, checked by mock-server
+		"schemaREPREQv2":   "misc/rep_req_v2.json",
+		"schemaREPBATCHv2": "misc/rep_batch_v2.json",
+	}
+	// These refer to HAR 1.2 definitions
+	withHAR := map[string]bool{
+		"schemaREQv1":   true,
+		"schemaREQv2":   true,
+		"schemaBATCHv2": true,
 	}
 
 	out, err := os.Create("schemas.go")
@@ -47,7 +60,7 @@ func main() {
 		fmt.Fprintln(out, "}")
 
 		loader := name + "Loader"
-		if name != "schemaREQv1" {
+		if !withHAR[name] {
 			fd, err := os.Open(path)
 			if err != nil {
 				panic(err)
@@ -60,7 +73,7 @@ func main() {
 			fmt.Fprintf(&initFunc, "\tif %s, err = gojsonschema.NewSchema(%s); err != nil { panic(err) }\n", name, loader)
 		} else {
 			fmt.Fprintf(&initFunc, "\t%s := gojsonschema.NewStringLoader(`", loader)
-			if err := writeReqSchema(&initFunc); err != nil {
+			if err := writeReqSchema(&initFunc, path); err != nil {
 				panic(err)
 			}
 			fmt.Fprintln(&initFunc, "`)")
@@ -72,7 +85,7 @@ func main() {
 	io.Copy(out, &initFunc)
 }
 
-func writeReqSchema(fd *bytes.Buffer) (err error) {
+func writeReqSchema(fd *bytes.Buffer, path string) (err error) {
 	harStr, err := ioutil.ReadFile("misc/har_1.2.json")
 	if err != nil {
 		return
@@ -85,7 +98,7 @@ func writeReqSchema(fd *bytes.Buffer) (err error) {
 		return
 	}
 
-	reqStr, err := ioutil.ReadFile("misc/req_v1.json")
+	reqStr, err := ioutil.ReadFile(path)
 	if err != nil {
 		return
 	}
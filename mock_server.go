@@ -0,0 +1,544 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+)
+
+const (
+	mockAddr            = "localhost:6374"
+	mockAuthToken       = "mock-auth-token"
+	mockValidationToken = "mock-validation-token"
+)
+
+// mockCampaign describes what a mockServer makes the client run:
+// a list of tests, each being a list of HAR requests.
+type mockCampaign struct {
+	Tests [][]json.RawMessage `json:"tests"`
+}
+
+// mockServer is a local stand-in for the FuzzyMonkey backend.
+// It speaks the same /blob, /init, /next and /stream protocol and walks through
+// a scripted campaign, emitting commands validated by the same schemas
+// the client uses. Replies to req & batch commands are validated too.
+type mockServer struct {
+	sync.Mutex
+	campaign mockCampaign
+	sessions map[string]*mockSession
+	// Reqs counts req commands the client replied to
+	Reqs int
+	// Reasons lists why requests got no response
+	Reasons []string
+	// Failures lists the kinds of these Reasons
+	Failures []failureKind
+	// SentCookies counts requests reported to have sent cookies
+	SentCookies int
+	// Violations lists the assertions responses failed
+	Violations []string
+	// Versions lists the protocol versions the mock speaks.
+	// Set it to nil to mimic a server that predates negotiation.
+	Versions []uint
+
+	// DropEvery makes the mock hang up on every Nth exchange,
+	// after having processed it
+	DropEvery int
+	// OutageAfter makes the mock unavailable after that many exchanges
+	OutageAfter int
+	// Stream makes the mock offer the streaming transport
+	Stream bool
+	// Streamed counts replies received through the streaming transport
+	Streamed int
+	// Batch makes the mock send each test as a single batch command, over v2
+	Batch bool
+	// Resubmissions counts replies deduplicated thanks to their idempotency key
+	Resubmissions int
+	exchanges     int
+}
+
+// mockSession walks one client through the campaign.
+// Concurrent clients each get their own session.
+type mockSession struct {
+	*mockServer
+	v           uint
+	pending     cmdKind
+	t, r        int
+	passed      *bool
+	failure     bool
+	lastKey     string
+	lastPayload []byte
+}
+
+func defaultMockCampaign() mockCampaign {
+	get := json.RawMessage(`{
+		"method": "GET",
+		"url": "http://localhost/",
+		"httpVersion": "HTTP/1.1",
+		"cookies": [],
+		"headers": [{"name": "User-Agent", "value": "FuzzyMonkey.co/mock"}],
+		"queryString": [],
+		"headersSize": -1,
+		"bodySize": 0
+	}`)
+	return mockCampaign{Tests: [][]json.RawMessage{
+		{get},
+		{get, get},
+		{get, get, get},
+	}}
+}
+
+func readMockCampaign(path string) (campaign mockCampaign, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Println("[ERR]", err)
+		return
+	}
+
+	if err = json.Unmarshal(data, &campaign); err != nil {
+		log.Println("[ERR]", err)
+	}
+	return
+}
+
+func newMockServer(campaign mockCampaign) *mockServer {
+	return &mockServer{
+		campaign: campaign,
+		sessions: make(map[string]*mockSession),
+		Versions: []uint{1, 2},
+	}
+}
+
+func doMockServer(addr, campaignPath string) int {
+	campaign := defaultMockCampaign()
+	if campaignPath != "" {
+		var err error
+		if campaign, err = readMockCampaign(campaignPath); err != nil {
+			fmt.Printf("Could not read campaign '%s'\n", campaignPath)
+			return 2
+		}
+	}
+
+	mock := newMockServer(campaign)
+	mock.Stream = true
+
+	fmt.Printf("Mock FuzzyMonkey server listening on http://%s\n", addr)
+	fmt.Printf("Try: %s --api-root=http://%s fuzz\n", binName, addr)
+	if err := http.ListenAndServe(addr, mock); err != nil {
+		log.Println("[ERR]", err)
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+func (m *mockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && r.URL.Path == "/stream" {
+		m.serveStream(w, r)
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("[ERR]", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("[DBG] mock 🡳  %s %s\n  🡳  %s\n", r.Method, r.URL.Path, body)
+
+	switch {
+	case r.Method == http.MethodPut && r.URL.Path == "/blob":
+		m.serveBlob(w, body)
+	case r.Method == http.MethodPut && r.URL.Path == "/init":
+		m.serveInit(w, r, body)
+	case r.Method == http.MethodPost && r.URL.Path == "/next":
+		m.serveNext(w, r, body)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *mockServer) serveBlob(w http.ResponseWriter, body []byte) {
+	var docs struct {
+		V     uint              `json:"v"`
+		Blobs map[string]string `json:"blobs"`
+	}
+	if err := json.Unmarshal(body, &docs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := docs.Blobs[localYML]; docs.V != v || !ok {
+		w.Header().Set("Content-Type", mimeJSON)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `[["%s", "missing"]]`, localYML)
+		return
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"v":     v,
+		"token": mockValidationToken,
+	})
+	m.reply(w, http.StatusCreated, payload)
+}
+
+func (m *mockServer) serveInit(w http.ResponseWriter, r *http.Request, body []byte) {
+	if r.Header.Get(xAPIKeyHeader) == "" {
+		http.Error(w, "missing "+xAPIKeyHeader, http.StatusUnauthorized)
+		return
+	}
+
+	s := &mockSession{mockServer: m, v: 1}
+	if m.Versions != nil {
+		offered := parseVs(r.Header.Get(xProtocolsHeader))
+		if s.v = m.pickVersion(offered); s.v == 0 {
+			err := fmt.Errorf("no common protocol version among %v", offered)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set(xProtocolHeader, formatVs([]uint{s.v}))
+	}
+	if m.Stream {
+		w.Header().Set(xCapabilitiesHeader, capStream)
+	}
+
+	payload, err := encodeMockCmd(s.simpleCmd(kindStart))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token := fmt.Sprintf("%s-%d", mockAuthToken, len(m.sessions)+1)
+	m.sessions[token] = s
+	w.Header().Set(xAuthTokenHeader, token)
+	m.reply(w, http.StatusCreated, payload)
+}
+
+func (m *mockServer) pickVersion(offered []uint) (best uint) {
+	for _, someV := range offered {
+		for _, mockV := range m.Versions {
+			if someV == mockV && someV > best {
+				best = someV
+			}
+		}
+	}
+	return
+}
+
+func (m *mockServer) serveNext(w http.ResponseWriter, r *http.Request, body []byte) {
+	s, ok := m.sessions[r.Header.Get(xAuthTokenHeader)]
+	if !ok {
+		http.Error(w, "bad "+xAuthTokenHeader, http.StatusUnauthorized)
+		return
+	}
+
+	code, payload, resubmitted, err := s.handleReply(r.Header.Get(xIdempotencyKeyHeader), body)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	if !resubmitted && m.shouldHangUp() {
+		if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			conn.Close()
+			return
+		}
+	}
+	m.reply(w, code, payload)
+}
+
+// serveStream upgrades the connection then handles one reply per line,
+// answering each with the next command on its own line.
+func (m *mockServer) serveStream(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	s, ok := m.sessions[r.Header.Get(xAuthTokenHeader)]
+	ok = ok && m.Stream
+	m.Unlock()
+	if !ok || r.Header.Get("Upgrade") != streamProtocol {
+		http.Error(w, "no streaming here", http.StatusBadRequest)
+		return
+	}
+
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Println("[ERR]", err)
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n")
+	fmt.Fprintf(rw, "Connection: Upgrade\r\nUpgrade: %s\r\n\r\n", streamProtocol)
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	for {
+		line, err := rw.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		log.Printf("[DBG] mock 🡳  stream\n  🡳  %s\n", line)
+
+		var frame streamFrame
+		if err := json.Unmarshal(line, &frame); err != nil {
+			log.Println("[ERR]", err)
+			return
+		}
+
+		m.Lock()
+		_, payload, resubmitted, err := s.handleReply(frame.Key, frame.Rep)
+		hangUp := err == nil && !resubmitted && m.shouldHangUp()
+		m.Streamed++
+		m.Unlock()
+		if err != nil || hangUp {
+			return
+		}
+
+		log.Printf("[DBG] mock 🡱  stream\n  🡱  %s\n", payload)
+		rw.Write(payload)
+		rw.WriteByte('\n')
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (m *mockServer) shouldHangUp() bool {
+	if m.DropEvery != 0 && m.exchanges%m.DropEvery == 0 {
+		log.Println("[DBG] mock hangs up on exchange", m.exchanges)
+		return true
+	}
+	return false
+}
+
+// handleReply processes a reply to the pending command and makes the next one.
+// Replies with the same idempotency key as the previous one get the same answer.
+func (m *mockSession) handleReply(key string, body []byte) (code int, payload []byte, resubmitted bool, err error) {
+	if m.OutageAfter != 0 && m.exchanges >= m.OutageAfter {
+		code, err = http.StatusServiceUnavailable, fmt.Errorf("scheduled outage")
+		return
+	}
+
+	if key != "" && key == m.lastKey {
+		m.Resubmissions++
+		code, payload, resubmitted = http.StatusOK, m.lastPayload, true
+		return
+	}
+
+	type mockReqRep struct {
+		Lane       lane            `json:"lane"`
+		Reason     string          `json:"reason"`
+		Failure    failureKind     `json:"failure"`
+		HARRep     json.RawMessage `json:"har_rep"`
+		Violations []string        `json:"violations"`
+	}
+	var rep struct {
+		mockReqRep
+		V      uint         `json:"v"`
+		Cmd    cmdKind      `json:"cmd"`
+		Failed bool         `json:"failed"`
+		Reps   []mockReqRep `json:"reps"`
+	}
+	if err = json.Unmarshal(body, &rep); err != nil {
+		code = http.StatusBadRequest
+		return
+	}
+	if rep.V != m.v || rep.Cmd != m.pending {
+		code = http.StatusBadRequest
+		err = fmt.Errorf("expected a reply to %s v%d, got %s v%d", m.pending, m.v, rep.Cmd, rep.V)
+		return
+	}
+	if code, err = m.validateReply(body); err != nil {
+		return
+	}
+
+	switch m.pending {
+	case kindStart, kindReset:
+		if rep.Failed {
+			m.setPassed(false)
+		}
+	case kindReq:
+		m.Reqs++
+		if rep.Lane.T != uint(m.t) || rep.Lane.R != uint(m.r) {
+			code = http.StatusBadRequest
+			err = fmt.Errorf("expected lane %d.%d, got %d.%d", m.t, m.r, rep.Lane.T, rep.Lane.R)
+			return
+		}
+		m.collectReqRep(rep.Reason, rep.Failure, rep.HARRep, rep.Violations)
+	case kindBatch:
+		for i, reqRep := range rep.Reps {
+			m.Reqs++
+			if reqRep.Lane.T != uint(m.t) || reqRep.Lane.R != uint(i+1) {
+				code = http.StatusBadRequest
+				err = fmt.Errorf("expected lane %d.%d, got %d.%d", m.t, i+1, reqRep.Lane.T, reqRep.Lane.R)
+				return
+			}
+			m.collectReqRep(reqRep.Reason, reqRep.Failure, reqRep.HARRep, reqRep.Violations)
+		}
+	}
+
+	if payload, err = encodeMockCmd(m.nextCmd()); err != nil {
+		code = http.StatusInternalServerError
+		return
+	}
+	m.lastKey, m.lastPayload = key, payload
+	m.exchanges++
+	code = http.StatusOK
+	return
+}
+
+// validateReply checks replies to req & batch commands against their schema
+func (m *mockSession) validateReply(body []byte) (code int, err error) {
+	isValid := map[cmdKind]func([]byte) (bool, error){
+		kindReq:   isValidForSchemaREPREQv2,
+		kindBatch: isValidForSchemaREPBATCHv2,
+	}[m.pending]
+	if m.v < 2 || isValid == nil {
+		return
+	}
+
+	valid, err := isValid(body)
+	if err == nil && !valid {
+		err = fmt.Errorf("invalid reply to %s: %s", m.pending, body)
+	}
+	if err != nil {
+		code = http.StatusBadRequest
+	}
+	return
+}
+
+func (m *mockSession) collectReqRep(reason string, failure failureKind, harRep json.RawMessage, violations []string) {
+	if reason != "" {
+		m.Reasons = append(m.Reasons, reason)
+		m.Failures = append(m.Failures, failure)
+	}
+	m.countSentCookies(harRep)
+	m.Violations = append(m.Violations, violations...)
+	m.setPassed(reason == "" && mockStatusOK(harRep) && len(violations) == 0)
+}
+
+func (m *mockSession) setPassed(passed bool) {
+	if m.passed == nil || *m.passed {
+		m.passed = &passed
+	}
+}
+
+func (m *mockSession) countSentCookies(harRep json.RawMessage) {
+	var entry struct {
+		Request struct {
+			Cookies []json.RawMessage `json:"cookies"`
+		} `json:"request"`
+	}
+	if err := json.Unmarshal(harRep, &entry); err == nil && len(entry.Request.Cookies) != 0 {
+		m.SentCookies++
+	}
+}
+
+func mockStatusOK(harRep json.RawMessage) bool {
+	var entry struct {
+		Response struct {
+			Status int `json:"status"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal(harRep, &entry); err != nil {
+		return false
+	}
+	return entry.Response.Status != 0 && entry.Response.Status < 500
+}
+
+func (m *mockSession) nextCmd() interface{} {
+	switch m.pending {
+	case kindStart:
+		return m.nextTest()
+	case kindReset:
+		m.r = 1
+		if m.Batch && m.v >= 2 {
+			return m.batchCmd()
+		}
+		return m.reqCmd()
+	case kindReq:
+		if m.r < len(m.campaign.Tests[m.t-1]) {
+			m.r++
+			return m.reqCmd()
+		}
+		return m.nextTest()
+	case kindBatch:
+		return m.nextTest()
+	case kindStop:
+		m.pending = kindDone
+		return map[string]interface{}{
+			"v":       m.v,
+			"cmd":     kindDone,
+			"failure": m.failure,
+		}
+	}
+	return nil
+}
+
+func (m *mockSession) nextTest() interface{} {
+	if m.passed != nil && !*m.passed {
+		m.failure = true
+	}
+
+	if m.failure || m.t == len(m.campaign.Tests) {
+		return m.simpleCmd(kindStop)
+	}
+
+	m.t++
+	return m.simpleCmd(kindReset)
+}
+
+func (m *mockSession) simpleCmd(kind cmdKind) interface{} {
+	m.pending = kind
+	cmd := map[string]interface{}{
+		"v":              m.v,
+		"cmd":            kind,
+		"passed":         m.passed,
+		"shrinking_from": nil,
+	}
+	m.passed = nil
+	return cmd
+}
+
+func (m *mockSession) reqCmd() interface{} {
+	m.pending = kindReq
+	return map[string]interface{}{
+		"v":       m.v,
+		"cmd":     kindReq,
+		"lane":    lane{T: uint(m.t), R: uint(m.r)},
+		"har_req": m.campaign.Tests[m.t-1][m.r-1],
+	}
+}
+
+func (m *mockSession) batchCmd() interface{} {
+	m.pending = kindBatch
+	return map[string]interface{}{
+		"v":        m.v,
+		"cmd":      kindBatch,
+		"lane":     lane{T: uint(m.t), R: 1},
+		"har_reqs": m.campaign.Tests[m.t-1],
+	}
+}
+
+func encodeMockCmd(cmd interface{}) (payload []byte, err error) {
+	if payload, err = json.Marshal(cmd); err != nil {
+		log.Println("[ERR]", err)
+		return
+	}
+
+	if _, err = unmarshalCmd(payload); err != nil {
+		log.Println("[ERR] mock emitted an invalid command:", err)
+	}
+	return
+}
+
+func (m *mockServer) reply(w http.ResponseWriter, code int, payload []byte) {
+	log.Printf("[DBG] mock 🡱  %d\n  🡱  %s\n", code, payload)
+	w.Header().Set("Content-Type", mimeJSON)
+	w.WriteHeader(code)
+	w.Write(payload)
+}
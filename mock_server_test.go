@@ -0,0 +1,825 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type mockRun struct {
+	campaign mockCampaign
+	sut      http.HandlerFunc
+	// tls serves the mock over HTTPS, trusted through $FUZZYMONKEY_CA_FILE
+	tls bool
+	// dropEvery makes the mock hang up every so many exchanges
+	dropEvery int
+	// stream makes the mock offer the streaming transport
+	stream bool
+	// batch makes the mock send one batch command per test
+	batch bool
+	// basePath is where the SUT's API is mounted
+	basePath string
+	// sutTLS serves the SUT over HTTPS, requiring a client certificate.
+	// The SUT's certificate & key are written to sut.pem & sut.key
+	sutTLS bool
+	// h2c serves the SUT over HTTP/2 in cleartext too
+	h2c bool
+	// targetTLS is the target's tls section of .fuzzymonkey.yml
+	targetTLS string
+	// targetYML is appended to the target section of .fuzzymonkey.yml
+	targetYML string
+	// yml is appended to .fuzzymonkey.yml
+	yml string
+}
+
+// mockFixture runs the client against a mock server and a local SUT,
+// from within a temporary directory.
+type mockFixture struct {
+	t          *testing.T
+	mock       *mockServer
+	mockServer *httptest.Server
+	sutServer  *httptest.Server
+	hits       int64
+	cwd, dir   string
+}
+
+func newMockFixture(t *testing.T, run mockRun) *mockFixture {
+	f := &mockFixture{t: t}
+	var err error
+	if f.cwd, err = os.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+	if f.dir, err = ioutil.TempDir("", binName+"_mock"); err != nil {
+		t.Fatal(err)
+	}
+
+	f.sutServer = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&f.hits, 1)
+		run.sut(w, r)
+	}))
+	target := "http://" + f.sutServer.Listener.Addr().String() + run.basePath
+	if run.h2c {
+		f.sutServer.Config.Handler = h2cHandler(f.sutServer.Config.Handler)
+	}
+	if run.sutTLS {
+		f.sutServer.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+		f.sutServer.StartTLS()
+		target = f.sutServer.URL
+		f.writeSUTKeyPair()
+	} else {
+		f.sutServer.Start()
+	}
+
+	f.mock = newMockServer(run.campaign)
+	f.mock.DropEvery = run.dropEvery
+	f.mock.Stream = run.stream
+	f.mock.Batch = run.batch
+	if run.tls {
+		f.mockServer = httptest.NewTLSServer(f.mock)
+		caFile := filepath.Join(f.dir, "ca.pem")
+		block := &pem.Block{Type: "CERTIFICATE", Bytes: f.mockServer.Certificate().Raw}
+		if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(block), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Setenv(envCAFile, caFile)
+	} else {
+		f.mockServer = httptest.NewServer(f.mock)
+	}
+
+	if err := os.Chdir(f.dir); err != nil {
+		t.Fatal(err)
+	}
+
+	yml := `version: 0
+documentation:
+  kind: openapi_v2
+`
+	if run.basePath != "" || run.sutTLS || run.targetYML != "" {
+		yml += fmt.Sprintf("target:\n  url: %s\n", target)
+		if run.targetTLS != "" {
+			yml += "  tls:\n" + run.targetTLS
+		}
+		yml += run.targetYML
+	} else {
+		host, port, err := net.SplitHostPort(f.sutServer.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		yml += fmt.Sprintf("  host: %s\n  port: '%s'\n", host, port)
+	}
+	yml += "reset:\n  - 'true'\n" + run.yml
+	if err := ioutil.WriteFile(localYML, []byte(yml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func (f *mockFixture) writeSUTKeyPair() {
+	writeKeyPair(f.t, f.dir, f.sutServer.TLS.Certificates[0])
+}
+
+// writeKeyPair writes cert & its key to dir/sut.pem & dir/sut.key
+func writeKeyPair(t *testing.T, dir string, cert tls.Certificate) {
+	key, ok := cert.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		t.Fatalf("unexpected key type %T", cert.PrivateKey)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(filepath.Join(dir, "sut.pem"), certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sut.key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recordMock keeps all that the mock receives
+func (f *mockFixture) recordMock() *bytes.Buffer {
+	var received bytes.Buffer
+	handler := f.mockServer.Config.Handler
+	f.mockServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		received.Write(body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		handler.ServeHTTP(w, r)
+	})
+	return &received
+}
+
+// leaked lists the secrets found in received
+func leaked(received *bytes.Buffer, secrets ...string) (leaks []string) {
+	for _, secret := range secrets {
+		if strings.Contains(received.String(), secret) {
+			leaks = append(leaks, secret)
+		}
+	}
+	return
+}
+
+func (f *mockFixture) close() {
+	os.Chdir(f.cwd)
+	os.RemoveAll(f.dir)
+	os.Unsetenv(envCAFile)
+	f.mockServer.Close()
+	f.sutServer.Close()
+}
+
+func (f *mockFixture) fuzz(args ...string) int {
+	return f.run(append([]string{"--api-root=" + f.mockServer.URL, "fuzz"}, args...)...)
+}
+
+func (f *mockFixture) run(args ...string) int {
+	oldArgs, oldAPIKey := os.Args, os.Getenv(envAPIKey)
+	os.Args = append([]string{binName}, args...)
+	os.Setenv(envAPIKey, "42")
+	defer func() {
+		os.Args = oldArgs
+		os.Setenv(envAPIKey, oldAPIKey)
+		log.SetOutput(os.Stderr)
+	}()
+
+	lastLane, shrinkingFrom, totalR = lane{}, lane{}, 0
+	lastReplySeq, protocolV = 0, 1
+	clearHAR()
+	latencies = make(map[string][]uint64)
+	return actualMain()
+}
+
+func (run mockRun) fuzz(t *testing.T) (int, *mockServer, int64) {
+	f := newMockFixture(t, run)
+	defer f.close()
+	code := f.fuzz()
+	return code, f.mock, atomic.LoadInt64(&f.hits)
+}
+
+// captureStdout returns what fn printed
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	printed := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		printed <- data
+	}()
+
+	oldStdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = oldStdout }()
+	fn()
+	w.Close()
+	return string(<-printed)
+}
+
+func sutOK(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", mimeJSON)
+	fmt.Fprintln(w, `{"ok": true}`)
+}
+
+func fastRetries() func() {
+	oldDelay := retryBaseDelay
+	retryBaseDelay = time.Millisecond
+	return func() { retryBaseDelay = oldDelay }
+}
+
+func TestMockServerNoBugs(t *testing.T) {
+	run := mockRun{campaign: defaultMockCampaign(), sut: sutOK}
+	code, mock, hits := run.fuzz(t)
+
+	if code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if mock.Reqs != 6 || hits != 6 {
+		t.Errorf("expected 6 requests, got %d replies and %d hits", mock.Reqs, hits)
+	}
+	if totalR != 6 || lastLane != (lane{T: 3, R: 3}) {
+		t.Errorf("unexpected totalR=%d lastLane=%+v", totalR, lastLane)
+	}
+	if protocolV != 2 {
+		t.Errorf("expected protocol v2 to be negotiated, got v%d", protocolV)
+	}
+}
+
+func TestMockServerPredatingNegotiation(t *testing.T) {
+	f := newMockFixture(t, mockRun{campaign: defaultMockCampaign(), sut: sutOK})
+	defer f.close()
+
+	f.mock.Versions = nil
+	if code := f.fuzz(); code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if protocolV != 1 || f.mock.Reqs != 6 {
+		t.Errorf("expected 6 requests over v1, got %d over v%d", f.mock.Reqs, protocolV)
+	}
+}
+
+func TestMockServerFindsBug(t *testing.T) {
+	run := mockRun{
+		campaign: defaultMockCampaign(),
+		sut: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		},
+	}
+	code, mock, hits := run.fuzz(t)
+
+	if code != 6 {
+		t.Errorf("expected exit code 6, got %d", code)
+	}
+	if mock.Reqs != 1 || hits != 1 {
+		t.Errorf("expected 1 request, got %d replies and %d hits", mock.Reqs, hits)
+	}
+}
+
+func TestMockServerReproducesFailingTest(t *testing.T) {
+	var seen int64
+	f := newMockFixture(t, mockRun{
+		campaign: defaultMockCampaign(),
+		sut: func(w http.ResponseWriter, r *http.Request) {
+			// Test #2 fails on its second request
+			if atomic.AddInt64(&seen, 1) >= 3 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			sutOK(w, r)
+		},
+	})
+	defer f.close()
+
+	if code := f.fuzz(); code != 6 {
+		t.Fatalf("expected exit code 6, got %d", code)
+	}
+	if hits := atomic.LoadInt64(&f.hits); hits != 3 {
+		t.Fatalf("expected 3 requests, got %d", hits)
+	}
+
+	if code := f.run("repro"); code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if hits := atomic.LoadInt64(&f.hits); hits != 5 {
+		t.Errorf("expected the 2 requests of test #2 again, got %d in total", hits)
+	}
+}
+
+func TestMockServerReproducesFailedAssertion(t *testing.T) {
+	var seen int64
+	f := newMockFixture(t, mockRun{
+		campaign: defaultMockCampaign(),
+		sut: func(w http.ResponseWriter, r *http.Request) {
+			// Test #2 fails on its second request
+			if atomic.AddInt64(&seen, 1) >= 3 {
+				w.Header().Set("Content-Type", mimeJSON)
+				fmt.Fprintln(w, `{"ok": false}`)
+				return
+			}
+			sutOK(w, r)
+		},
+		yml: `assertions:
+  - json:
+      - path: $.ok
+        equals: true
+`,
+	})
+	defer f.close()
+
+	if code := f.fuzz(); code != 6 {
+		t.Fatalf("expected exit code 6, got %d", code)
+	}
+
+	var code int
+	output := captureStdout(t, func() { code = f.run("repro") })
+	if code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if expected := "✗ $.ok: got false, expected true\n"; !strings.Contains(output, expected) {
+		t.Errorf("expected %q in %s", expected, output)
+	}
+}
+
+func TestMockServerTargetBasePath(t *testing.T) {
+	var mu sync.Mutex
+	paths := make(map[string]int)
+	run := mockRun{
+		campaign: defaultMockCampaign(),
+		basePath: "/api/v1/",
+		sut: func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			paths[r.URL.Path]++
+			mu.Unlock()
+			sutOK(w, r)
+		},
+	}
+	if code, _, _ := run.fuzz(t); code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if expected := map[string]int{"/api/v1/": 6}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected requests under the base path, got %v", paths)
+	}
+}
+
+func TestMockServerTargetMutualTLS(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	run := mockRun{
+		campaign: defaultMockCampaign(),
+		sut: func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			seen = append(seen, fmt.Sprintf("%s %d", r.TLS.ServerName, len(r.TLS.PeerCertificates)))
+			mu.Unlock()
+			sutOK(w, r)
+		},
+		sutTLS: true,
+		// The SUT presents its own certificate as a client
+		targetTLS: `    ca_file: sut.pem
+    cert_file: sut.pem
+    key_file: sut.key
+    server_name: example.com
+`,
+	}
+	if code, _, _ := run.fuzz(t); code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if len(seen) == 0 {
+		t.Error("expected requests")
+	}
+	for _, got := range seen {
+		if got != "example.com 1" {
+			t.Errorf("expected a client certificate sent to example.com, got %q", got)
+		}
+	}
+}
+
+func TestMockServerTargetH2C(t *testing.T) {
+	var mu sync.Mutex
+	var protos []string
+	run := mockRun{
+		campaign: defaultMockCampaign(),
+		sut: func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			protos = append(protos, r.Proto)
+			mu.Unlock()
+			sutOK(w, r)
+		},
+		h2c: true,
+		targetYML: `  http2: h2c
+`,
+	}
+	code, _, _ := run.fuzz(t)
+
+	if code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if len(protos) == 0 {
+		t.Error("expected requests")
+	}
+	for _, proto := range protos {
+		if proto != "HTTP/2.0" {
+			t.Errorf("expected the SUT to see HTTP/2.0, got %s", proto)
+		}
+	}
+}
+
+func TestMockServerTargetTimeout(t *testing.T) {
+	run := mockRun{
+		campaign: defaultMockCampaign(),
+		sut: func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(time.Second)
+		},
+		targetYML: `  timeouts:
+    request: 50ms
+`,
+	}
+	code, mock, _ := run.fuzz(t)
+
+	if code != 6 {
+		t.Errorf("expected exit code 6, got %d", code)
+	}
+	if len(mock.Reasons) != 1 || !strings.HasPrefix(mock.Reasons[0], reasonTimeout) {
+		t.Errorf("expected 1 timeout, got %q", mock.Reasons)
+	}
+	if !reflect.DeepEqual(mock.Failures, []failureKind{failureTimeout}) {
+		t.Errorf("expected 1 timeout failure, got %q", mock.Failures)
+	}
+}
+
+func TestMockServerAuthIsNotReported(t *testing.T) {
+	os.Setenv("MONKEY_TEST_API_KEY", "k3y")
+	defer os.Unsetenv("MONKEY_TEST_API_KEY")
+	f := newMockFixture(t, mockRun{
+		campaign: defaultMockCampaign(),
+		sut: func(w http.ResponseWriter, r *http.Request) {
+			if user, pass, ok := r.BasicAuth(); !ok || user != "monkey" || pass != "s3cr3t" ||
+				r.Header.Get("X-Api-Key") != "k3y" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			sutOK(w, r)
+		},
+		yml: `auth:
+  headers:
+    X-Api-Key: '{{ env "MONKEY_TEST_API_KEY" }}'
+  basic:
+    username: monkey
+    password: s3cr3t
+`,
+	})
+	defer f.close()
+	received := f.recordMock()
+
+	if code := f.fuzz(); code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	basic := base64.StdEncoding.EncodeToString([]byte("monkey:s3cr3t"))
+	if leaks := leaked(received, "k3y", basic); len(leaks) != 0 {
+		t.Errorf("expected no credentials sent to the mock, got %q", leaks)
+	}
+}
+
+func TestMockServerSigningIsNotReported(t *testing.T) {
+	os.Setenv("MONKEY_TEST_TOKEN", "t0k3n")
+	defer os.Unsetenv("MONKEY_TEST_TOKEN")
+	var mu sync.Mutex
+	var signatures []string
+	f := newMockFixture(t, mockRun{
+		campaign: defaultMockCampaign(),
+		sut: func(w http.ResponseWriter, r *http.Request) {
+			mac := hmac.New(sha256.New, []byte("s3cr3t"))
+			fmt.Fprintf(mac, "%s\n%s\n%s\n", r.Method, r.URL.RequestURI(), r.Header.Get("X-Ts"))
+			signature := hex.EncodeToString(mac.Sum(nil))
+			if r.Header.Get("X-Sig") != signature ||
+				r.Header.Get("X-Amz-Security-Token") != "t0k3n" ||
+				r.Header.Get("X-Hooked") != "h00k" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			mu.Lock()
+			signatures = append(signatures, signature)
+			mu.Unlock()
+			sutOK(w, r)
+		},
+		yml: `signing:
+  hmac:
+    secret: s3cr3t
+    header: X-Sig
+    timestamp_header: X-Ts
+  aws_sigv4:
+    region: eu-west-1
+    service: execute-api
+    access_key_id: AKIDEXAMPLE
+    secret_access_key: s3cr3t
+    session_token: '{{ env "MONKEY_TEST_TOKEN" }}'
+  exec: |
+    cat >/dev/null
+    echo "X-Hooked: $(printf h0)0k"
+`,
+	})
+	defer f.close()
+	received := f.recordMock()
+
+	if code := f.fuzz(); code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if len(signatures) == 0 {
+		t.Error("expected signed requests")
+	}
+	if leaks := leaked(received, append(signatures, "t0k3n", "h00k")...); len(leaks) != 0 {
+		t.Errorf("expected no signatures sent to the mock, got %q", leaks)
+	}
+}
+
+func TestMockServerCookieJarIsNotReported(t *testing.T) {
+	var withCookie int64
+	f := newMockFixture(t, mockRun{
+		campaign: defaultMockCampaign(),
+		sut: func(w http.ResponseWriter, r *http.Request) {
+			if _, err := r.Cookie("session"); err == nil {
+				atomic.AddInt64(&withCookie, 1)
+			} else {
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: "s3ss10n"})
+			}
+			sutOK(w, r)
+		},
+		targetYML: `  cookie_jar: true
+`,
+	})
+	defer f.close()
+	received := f.recordMock()
+
+	if code := f.fuzz(); code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	// Tests of 1, 2 & 3 requests: all but their first send the cookie
+	if withCookie := atomic.LoadInt64(&withCookie); withCookie != 3 {
+		t.Errorf("expected 3 requests with the cookie, got %d", withCookie)
+	}
+	if f.mock.SentCookies != 3 {
+		t.Errorf("expected 3 HAR entries with cookies, got %d", f.mock.SentCookies)
+	}
+	if leaks := leaked(received, "s3ss10n"); len(leaks) != 0 {
+		t.Errorf("expected no cookies sent to the mock, got %q", leaks)
+	}
+}
+
+func TestMockServerAssertionsFail(t *testing.T) {
+	run := mockRun{
+		campaign: defaultMockCampaign(),
+		sut:      sutOK,
+		yml: `assertions:
+  - path: /*
+    headers:
+      X-Request-Id: '*'
+    json:
+      - path: $['ok']
+        equals: false
+`,
+	}
+	code, mock, _ := run.fuzz(t)
+
+	if code != 6 {
+		t.Errorf("expected exit code 6, got %d", code)
+	}
+	expected := []string{
+		`header X-Request-Id: got "", expected "*"`,
+		`$['ok']: got true, expected false`,
+	}
+	if !reflect.DeepEqual(mock.Violations, expected) {
+		t.Errorf("expected violations %q, got %q", expected, mock.Violations)
+	}
+}
+
+func TestMockServerLatencyBudget(t *testing.T) {
+	run := mockRun{
+		campaign: defaultMockCampaign(),
+		sut: func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(20 * time.Millisecond)
+			sutOK(w, r)
+		},
+		yml: `assertions:
+  - path: /
+    max_latency: 5ms
+`,
+	}
+	code, mock, _ := run.fuzz(t)
+
+	if code != 6 {
+		t.Errorf("expected exit code 6, got %d", code)
+	}
+	if len(mock.Violations) != 1 || !strings.HasPrefix(mock.Violations[0], "latency ") {
+		t.Errorf("expected 1 latency violation, got %q", mock.Violations)
+	}
+	if got := latencies["GET /"]; len(got) != 1 || got[0] < 20000 {
+		t.Errorf("expected 1 latency of at least 20ms, got %v", got)
+	}
+}
+
+func TestMockServerOverTLSWithCustomCA(t *testing.T) {
+	run := mockRun{campaign: defaultMockCampaign(), sut: sutOK, tls: true}
+	code, mock, _ := run.fuzz(t)
+
+	if code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if mock.Reqs != 6 {
+		t.Errorf("expected 6 requests, got %d", mock.Reqs)
+	}
+}
+
+func TestMockServerResubmissionsAfterHangups(t *testing.T) {
+	defer fastRetries()()
+
+	run := mockRun{campaign: defaultMockCampaign(), sut: sutOK, dropEvery: 3}
+	code, mock, hits := run.fuzz(t)
+
+	if code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if mock.Reqs != 6 || hits != 6 {
+		t.Errorf("expected 6 requests, got %d replies and %d hits", mock.Reqs, hits)
+	}
+	if mock.Resubmissions == 0 {
+		t.Errorf("expected some resubmissions")
+	}
+}
+
+func TestMockServerResumeAfterOutage(t *testing.T) {
+	defer fastRetries()()
+
+	f := newMockFixture(t, mockRun{campaign: defaultMockCampaign(), sut: sutOK})
+	defer f.close()
+
+	f.mock.OutageAfter = 4
+	if code := f.fuzz(); code != 1 {
+		t.Fatalf("expected exit code 1, got %d", code)
+	}
+	if _, err := os.Stat(sessionID()); err != nil {
+		t.Fatalf("expected a session file: %v", err)
+	}
+
+	f.mock.OutageAfter = 0
+	if code := f.fuzz("--resume"); code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if f.mock.Reqs != 6 || totalR != 6 {
+		t.Errorf("expected 6 requests, got %d replies and totalR=%d", f.mock.Reqs, totalR)
+	}
+	if _, err := os.Stat(sessionID()); !os.IsNotExist(err) {
+		t.Errorf("expected session file to be gone: %v", err)
+	}
+}
+
+func TestMockServerStreaming(t *testing.T) {
+	run := mockRun{campaign: defaultMockCampaign(), sut: sutOK, stream: true}
+	code, mock, hits := run.fuzz(t)
+
+	if code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if mock.Reqs != 6 || hits != 6 {
+		t.Errorf("expected 6 requests, got %d replies and %d hits", mock.Reqs, hits)
+	}
+	// start, 3 resets, 6 reqs & stop
+	if mock.Streamed != 11 {
+		t.Errorf("expected all 11 replies to be streamed, got %d", mock.Streamed)
+	}
+}
+
+func TestMockServerStreamingFallsBack(t *testing.T) {
+	defer fastRetries()()
+
+	run := mockRun{campaign: defaultMockCampaign(), sut: sutOK, stream: true, dropEvery: 4}
+	code, mock, hits := run.fuzz(t)
+
+	if code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if mock.Reqs != 6 || hits != 6 {
+		t.Errorf("expected 6 requests, got %d replies and %d hits", mock.Reqs, hits)
+	}
+	if mock.Streamed != 4 || mock.Resubmissions == 0 {
+		t.Errorf("expected 4 streamed then some resubmitted, got %d and %d",
+			mock.Streamed, mock.Resubmissions)
+	}
+}
+
+func TestMockServerBatches(t *testing.T) {
+	run := mockRun{campaign: defaultMockCampaign(), sut: sutOK, batch: true}
+	code, mock, hits := run.fuzz(t)
+
+	if code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if mock.Reqs != 6 || hits != 6 {
+		t.Errorf("expected 6 requests, got %d replies and %d hits", mock.Reqs, hits)
+	}
+	if totalR != 6 || lastLane != (lane{T: 3, R: 3}) {
+		t.Errorf("unexpected totalR=%d lastLane=%+v", totalR, lastLane)
+	}
+	// start, 3 resets, 3 batches & stop
+	if mock.exchanges != 8 {
+		t.Errorf("expected 8 exchanges, got %d", mock.exchanges)
+	}
+}
+
+func TestMockServerRecordThenReplay(t *testing.T) {
+	var crash int32
+	f := newMockFixture(t, mockRun{
+		campaign: defaultMockCampaign(),
+		yml:      "stop:\n  - touch stopped\n",
+		sut: func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&crash) != 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			sutOK(w, r)
+		},
+	})
+	defer f.close()
+
+	if code := f.fuzz("--record=session.json"); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+
+	if code := f.run("replay", "session.json"); code != 0 {
+		t.Errorf("expected replay to match, got exit code %d", code)
+	}
+	if hits := atomic.LoadInt64(&f.hits); hits != 12 {
+		t.Errorf("expected 6 more requests, got %d in total", hits)
+	}
+
+	atomic.StoreInt32(&crash, 1)
+	if code := f.run("replay", "session.json"); code != 8 {
+		t.Errorf("expected replay to diverge, got exit code %d", code)
+	}
+	atomic.StoreInt32(&crash, 0)
+
+	// Cut before the stop command
+	recording, err := ioutil.ReadFile("session.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(recording), "\n")
+	truncated := strings.Join(lines[:len(lines)-4], "\n")
+	if err = ioutil.WriteFile("session.json", []byte(truncated), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("stopped")
+	if code := f.run("replay", "session.json"); code != 0 {
+		t.Errorf("expected truncated replay to match, got exit code %d", code)
+	}
+	if _, err = os.Stat("stopped"); err != nil {
+		t.Errorf("expected stop to run after a truncated replay: %v", err)
+	}
+}
+
+func TestMockServerReplaysFailedRequests(t *testing.T) {
+	f := newMockFixture(t, mockRun{
+		campaign: defaultMockCampaign(),
+		sut: func(w http.ResponseWriter, r *http.Request) {
+			// Hang up without responding
+			if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+				conn.Close()
+			}
+		},
+	})
+	defer f.close()
+
+	if code := f.fuzz("--record=session.json"); code != 6 {
+		t.Fatalf("expected exit code 6, got %d", code)
+	}
+	recording, err := ioutil.ReadFile("session.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(recording, []byte(`"failure":"connection_reset"`)) {
+		t.Fatalf("expected failures to be recorded, got %s", recording)
+	}
+
+	// The fixture runs replay with the protocol version back at v1
+	if code := f.run("replay", "session.json"); code != 0 {
+		t.Errorf("expected replay to match, got exit code %d", code)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	xProtocolsHeader    = "X-Monkey-Protocols"
+	xProtocolHeader     = "X-Monkey-Protocol"
+	xCapabilitiesHeader = "X-Monkey-Capabilities"
+)
+
+var (
+	// protocolVs lists the protocol versions this client speaks, preferred first
+	protocolVs = []uint{2, 1}
+	// capabilities lists the optional protocol features this client supports
+	capabilities = []string{"idempotency-keys", "resume", capStream}
+	// serverCapabilities lists the optional features the server offers
+	serverCapabilities []string
+	// protocolV is the protocol version negotiated with the server
+	protocolV uint = 1
+)
+
+func isSupportedV(version uint) bool {
+	for _, someV := range protocolVs {
+		if someV == version {
+			return true
+		}
+	}
+	return false
+}
+
+func formatVs(vs []uint) string {
+	strs := make([]string, 0, len(vs))
+	for _, someV := range vs {
+		strs = append(strs, strconv.FormatUint(uint64(someV), 10))
+	}
+	return strings.Join(strs, ",")
+}
+
+func parseVs(str string) (vs []uint) {
+	for _, field := range strings.Split(str, ",") {
+		if someV, err := strconv.ParseUint(strings.TrimSpace(field), 10, 32); err == nil {
+			vs = append(vs, uint(someV))
+		}
+	}
+	return
+}
+
+func advertiseProtocols(r *http.Request) {
+	r.Header.Set(xProtocolsHeader, formatVs(protocolVs))
+	r.Header.Set(xCapabilitiesHeader, strings.Join(capabilities, ","))
+}
+
+func hasServerCapability(capability string) bool {
+	for _, someCapability := range serverCapabilities {
+		if someCapability == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateProtocol sets protocolV and serverCapabilities from the server's choices.
+// Servers that predate negotiation only speak v1.
+func negotiateProtocol(resp *http.Response) (err error) {
+	serverCapabilities = nil
+	for _, field := range strings.Split(resp.Header.Get(xCapabilitiesHeader), ",") {
+		if capability := strings.TrimSpace(field); capability != "" {
+			serverCapabilities = append(serverCapabilities, capability)
+		}
+	}
+
+	chosen := resp.Header.Get(xProtocolHeader)
+	if chosen == "" {
+		protocolV = 1
+		log.Println("[NFO] server did not negotiate: using protocol v1")
+		return
+	}
+
+	vs := parseVs(chosen)
+	if len(vs) != 1 || !isSupportedV(vs[0]) {
+		err = fmt.Errorf("server picked protocol %q but %s v%s only speaks %s",
+			chosen, binName, binVersion, formatVs(protocolVs))
+		log.Println("[ERR]", err)
+		fmt.Println(err)
+		fmt.Printf("Try: %s --update\n", binName)
+		return
+	}
+
+	protocolV = vs[0]
+	log.Printf("[NFO] using protocol v%d\n", protocolV)
+	return
+}
@@ -12,7 +12,10 @@ import (
 	"strings"
 )
 
-var pwdID string
+var (
+	pwdID     string
+	pwdPrefix string
+)
 
 func envID() string {
 	return pwdID + ".env"
@@ -26,6 +29,22 @@ func updateID() string {
 	return pwdID + "_update.bin"
 }
 
+func wireID() string {
+	return pwdID + ".wire"
+}
+
+// sessionID outlives runs: it is shared by all slots of the current directory
+// but each worker has its own.
+func sessionID() string {
+	return pwdPrefix + workerSuffix() + ".session.json"
+}
+
+// reproID outlives runs: it holds the last failing test of the current directory
+// (or of the current worker).
+func reproID() string {
+	return pwdPrefix + workerSuffix() + ".repro.json"
+}
+
 func makePwdID() (err error) {
 	cwd, err := os.Getwd()
 	if err != nil {
@@ -53,7 +72,8 @@ func makePwdID() (err error) {
 		return
 	}
 
-	pwdID = prefix + "_" + slot
+	pwdPrefix = prefix
+	pwdID = prefix + "_" + slot + workerSuffix()
 	return
 }
 
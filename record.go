@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+// recorder, when not nil, writes the dialogue to a file as it happens
+var recorder *dialogueRecorder
+
+// recordedExchange is a command received and the reply sent for it.
+// The last command (done) has no reply.
+type recordedExchange struct {
+	Cmd json.RawMessage `json:"cmd"`
+	Rep json.RawMessage `json:"rep,omitempty"`
+}
+
+// dialogueRecorder writes a JSON array of recordedExchange one entry at a time
+// so that an interrupted run still leaves a usable recording.
+type dialogueRecorder struct {
+	file    *os.File
+	pending json.RawMessage
+	count   int
+}
+
+func startRecording(path string) (err error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		log.Println("[ERR]", err)
+		fmt.Printf("Could not record to '%s'\n", path)
+		return
+	}
+
+	if _, err = file.WriteString("[\n"); err != nil {
+		log.Println("[ERR]", err)
+		file.Close()
+		return
+	}
+
+	log.Println("[NFO] recording dialogue to", path)
+	recorder = &dialogueRecorder{file: file}
+	return
+}
+
+func stopRecording() {
+	if recorder == nil {
+		return
+	}
+
+	if recorder.pending != nil {
+		recorder.write(recorder.pending, nil)
+	}
+	if _, err := recorder.file.WriteString("\n]\n"); err != nil {
+		log.Println("[ERR]", err)
+	}
+	if err := recorder.file.Close(); err != nil {
+		log.Println("[ERR]", err)
+	}
+	recorder = nil
+}
+
+func recordCmd(cmdJSON []byte) {
+	if recorder == nil {
+		return
+	}
+
+	if recorder.pending != nil {
+		recorder.write(recorder.pending, nil)
+	}
+	recorder.pending = cmdJSON
+}
+
+func recordRep(rep []byte) {
+	if recorder == nil {
+		return
+	}
+
+	recorder.write(recorder.pending, rep)
+	recorder.pending = nil
+}
+
+func (rec *dialogueRecorder) write(cmdJSON, rep []byte) {
+	entry, err := json.Marshal(&recordedExchange{Cmd: cmdJSON, Rep: rep})
+	if err != nil {
+		log.Println("[ERR]", err)
+		return
+	}
+
+	var buf bytes.Buffer
+	if rec.count != 0 {
+		buf.WriteString(",\n")
+	}
+	buf.Write(entry)
+	if _, err = rec.file.Write(buf.Bytes()); err != nil {
+		log.Println("[ERR]", err)
+		return
+	}
+	rec.count++
+}
+
+// readRecording reads back what dialogueRecorder wrote,
+// tolerating a recording cut short.
+func readRecording(path string) (exchanges []recordedExchange, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Println("[ERR]", err)
+		fmt.Printf("Could not read recording '%s'\n", path)
+		return
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	if _, err = decoder.Token(); err != nil {
+		log.Println("[ERR]", err)
+		fmt.Printf("'%s' is not a recording\n", path)
+		return
+	}
+
+	for decoder.More() {
+		var exchange recordedExchange
+		if err := decoder.Decode(&exchange); err != nil {
+			log.Println("[NFO] recording ends early:", err)
+			break
+		}
+		exchanges = append(exchanges, exchange)
+	}
+	return
+}
+
+// replayedReq is what replays compare of a request's reply
+type replayedReq struct {
+	Lane       lane        `json:"lane"`
+	Reason     string      `json:"reason"`
+	Failure    failureKind `json:"failure"`
+	Violations []string    `json:"violations"`
+	HARRep     *struct {
+		Response struct {
+			Status  int `json:"status"`
+			Content struct {
+				Text string `json:"text"`
+			} `json:"content"`
+		} `json:"response"`
+	} `json:"har_rep"`
+}
+
+func replayedReqs(kind cmdKind, rep []byte) (reqs []replayedReq, err error) {
+	if kind == kindBatch {
+		var batch struct {
+			Reps []replayedReq `json:"reps"`
+		}
+		err = json.Unmarshal(rep, &batch)
+		reqs = batch.Reps
+	} else {
+		var req replayedReq
+		err = json.Unmarshal(rep, &req)
+		reqs = []replayedReq{req}
+	}
+	if err != nil {
+		log.Println("[ERR]", err)
+	}
+	return
+}
+
+func (req *replayedReq) describe() string {
+	if req.Reason != "" {
+		if req.Failure != "" {
+			return fmt.Sprintf("no response (%s): %s", req.Failure, req.Reason)
+		}
+		return "no response: " + req.Reason
+	}
+	if req.HARRep == nil {
+		return "no response"
+	}
+	return fmt.Sprintf("status %d", req.HARRep.Response.Status)
+}
+
+// divergence describes how got differs from the recorded reply, if it does.
+// Bodies often hold timestamps or identifiers so they are only compared
+// when asked to.
+func (req *replayedReq) divergence(got *replayedReq, compareBodies bool) string {
+	if req.describe() != got.describe() {
+		return fmt.Sprintf("got %s, recorded %s", got.describe(), req.describe())
+	}
+	if compareBodies && req.HARRep != nil && got.HARRep != nil &&
+		req.HARRep.Response.Content.Text != got.HARRep.Response.Content.Text {
+		return fmt.Sprintf("response bodies differ:\n  got:      %q\n  recorded: %q",
+			got.HARRep.Response.Content.Text, req.HARRep.Response.Content.Text)
+	}
+	return ""
+}
+
+// setupLocalRun prepares for running commands without a FuzzyMonkey server.
+// A non-zero code is the one to exit with.
+func setupLocalRun() (cfg *ymlCfg, code int) {
+	if _, err := os.Stat(shell()); os.IsNotExist(err) {
+		log.Printf("%s is required\n", shell())
+		code = 5
+		return
+	}
+
+	yml, err := readYML()
+	if err != nil {
+		code = retryOrReport()
+		return
+	}
+	if cfg, err = newCfg(yml); err != nil {
+		code = retryOrReport()
+		return
+	}
+
+	if err = snapEnv(envID()); err != nil {
+		code = retryOrReport()
+	}
+	return
+}
+
+func doReplay(path string, compareBodies bool) int {
+	exchanges, err := readRecording(path)
+	if err != nil {
+		return 1
+	}
+
+	cfg, code := setupLocalRun()
+	if code != 0 {
+		return code
+	}
+	defer ensureDeleted(envID())
+	// Recordings cut short miss their stop
+	defer maybePostStop(cfg)
+	defer closeWire(cfg)
+
+	divergences := 0
+	for _, exchange := range exchanges {
+		cmd, err := unmarshalCmd(exchange.Cmd)
+		if err != nil {
+			return retryOrReportThenCleanup(cfg, err)
+		}
+
+		switch cmd.Kind() {
+		case kindDone:
+			// Nothing to replay
+		case kindStart, kindReset, kindStop:
+			if isHARReady() {
+				clearHAR()
+			}
+			fmt.Printf("Replaying %s\n", cmd.Kind())
+			if cmdRep := executeScript(cfg, cmd.Kind()); cmdRep.Failed {
+				return retryOrReportThenCleanup(cfg, fmt.Errorf("%s failed", cmd.Kind()))
+			}
+		case kindReq, kindBatch:
+			rep, err := cmd.Exec(cfg)
+			if err != nil {
+				return retryOrReportThenCleanup(cfg, err)
+			}
+			if exchange.Rep != nil {
+				divergences += reportDivergences(cmd.Kind(), exchange.Rep, rep, compareBodies)
+			}
+		}
+	}
+
+	fmt.Printf("Replayed %d requests: ", totalR)
+	if divergences != 0 {
+		fmt.Printf("%d diverged from the recording\n", divergences)
+		return 8
+	}
+	fmt.Println("all matched the recording")
+	return 0
+}
+
+func reportDivergences(kind cmdKind, recordedRep, rep []byte, compareBodies bool) (divergences int) {
+	recorded, err := replayedReqs(kind, recordedRep)
+	if err != nil {
+		return 1
+	}
+	got, err := replayedReqs(kind, rep)
+	if err != nil {
+		return 1
+	}
+
+	for i := range recorded {
+		at := recorded[i].Lane
+		if i >= len(got) {
+			fmt.Printf("✗ %d.%d: not replayed\n", at.T, at.R)
+			divergences++
+			continue
+		}
+
+		if why := recorded[i].divergence(&got[i], compareBodies); why != "" {
+			fmt.Printf("✗ %d.%d: %s\n", at.T, at.R, why)
+			divergences++
+			continue
+		}
+		fmt.Printf("✓ %d.%d: %s\n", at.T, at.R, got[i].describe())
+	}
+	return
+}
@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestReplayComparesBodiesOnlyWhenAsked(t *testing.T) {
+	rep := func(body string) []byte {
+		return []byte(`{"lane":{"t":1,"r":1},"har_rep":{"response":{"status":200,"content":{"text":"` + body + `"}}}}`)
+	}
+	recorded, got := rep(`{\"at\":1}`), rep(`{\"at\":2}`)
+
+	if n := reportDivergences(kindReq, recorded, got, false); n != 0 {
+		t.Errorf("expected no divergences, got %d", n)
+	}
+	if n := reportDivergences(kindReq, recorded, got, true); n != 1 {
+		t.Errorf("expected 1 divergence, got %d", n)
+	}
+}
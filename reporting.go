@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sebcat/har"
+)
+
+// reportingLevel decides how much of responses gets sent upstream
+type reportingLevel string
+
+const (
+	// reportFull sends HAR entries as recorded
+	reportFull reportingLevel = "full"
+	// reportNoBodies drops request & response bodies
+	reportNoBodies reportingLevel = "no_bodies"
+	// reportShapes replaces JSON bodies with their shape, e.g. {"id":"number"}
+	reportShapes reportingLevel = "shapes"
+	// reportHashes replaces bodies with their SHA-256
+	reportHashes reportingLevel = "hashes"
+
+	truncatedMarker = "…[truncated]"
+	redactedValue   = "[redacted]"
+)
+
+// redactedByDefault lists the headers & query parameters always carrying credentials
+var redactedByDefault = []string{authorizationHeader, "Proxy-Authorization", "Cookie", "Set-Cookie", "access_token"}
+
+// reportingYML is applied to replies before they are sent
+type reportingYML struct {
+	Level reportingLevel `yaml:"level"`
+	// MaxBodySize, when positive, truncates longer response bodies (in bytes)
+	MaxBodySize int `yaml:"max_body_size"`
+	// redacted holds the lowercased names of headers & query parameters never reported
+	redacted map[string]bool
+}
+
+// redact hides the values of these headers & query parameters from reports
+func (reporting *reportingYML) redact(names ...string) {
+	if reporting.redacted == nil {
+		reporting.redacted = make(map[string]bool, len(redactedByDefault)+len(names))
+		for _, name := range redactedByDefault {
+			reporting.redacted[strings.ToLower(name)] = true
+		}
+	}
+	for _, name := range names {
+		reporting.redacted[strings.ToLower(name)] = true
+	}
+}
+
+func (reporting *reportingYML) check() (err error) {
+	switch reporting.Level {
+	case "":
+		reporting.Level = reportFull
+	case reportFull, reportNoBodies, reportShapes, reportHashes:
+	default:
+		err = fmt.Errorf("unsupported reporting level %q: pick one of %s, %s, %s or %s",
+			reporting.Level, reportFull, reportNoBodies, reportShapes, reportHashes)
+	}
+	if err == nil && reporting.MaxBodySize < 0 {
+		err = fmt.Errorf("reporting max_body_size should be positive, got %d", reporting.MaxBodySize)
+	}
+	if err != nil {
+		log.Println("[ERR]", err)
+		fmt.Println(err)
+	}
+	return
+}
+
+// report returns what is sent of entry, leaving entry as recorded
+func (reporting *reportingYML) report(entry harEntry) harEntry {
+	reported := *entry
+	reported.Request.URL = reporting.redactURL(entry.Request.URL)
+	reported.Request.QueryString = reporting.redactNVPs(entry.Request.QueryString)
+	reported.Request.Headers = reporting.redactNVPs(entry.Request.Headers)
+	reported.Request.Cookies = redactCookies(entry.Request.Cookies)
+	reported.Response.Headers = reporting.redactNVPs(entry.Response.Headers)
+	reported.Response.Cookies = redactCookies(entry.Response.Cookies)
+	if reporting.Level == reportFull && reporting.MaxBodySize == 0 {
+		return &reported
+	}
+
+	if postData := reported.Request.PostData; postData != nil {
+		reportedPostData := *postData
+		reportedPostData.Text = reporting.body(postData.Text)
+		reported.Request.PostData = &reportedPostData
+	}
+	if content := &reported.Response.Content; content.Encoding == "base64" {
+		reporting.binaryBody(content)
+	} else {
+		content.Text = reporting.body(content.Text)
+	}
+	return &reported
+}
+
+// binaryBody is body for base64 content: it works on the decoded bytes
+// and leaves Text valid base64 when it still holds the body.
+func (reporting *reportingYML) binaryBody(content *harContent) {
+	data, err := base64.StdEncoding.DecodeString(content.Text)
+	if err != nil {
+		log.Println("[ERR]", err)
+		content.Text, content.Encoding = "", ""
+		return
+	}
+
+	if reporting.Level != reportFull {
+		content.Text, content.Encoding = reporting.body(string(data)), ""
+		return
+	}
+	if max := reporting.MaxBodySize; len(data) > max {
+		content.Text = base64.StdEncoding.EncodeToString(data[:max])
+		content.Comment = fmt.Sprintf("truncated to %d of %d bytes", max, content.Size)
+	}
+}
+
+func (reporting *reportingYML) redactNVPs(nvps []har.NVP) (redacted []har.NVP) {
+	if nvps == nil {
+		return
+	}
+	reporting.redact()
+	redacted = make([]har.NVP, len(nvps))
+	for i, nvp := range nvps {
+		if reporting.redacted[strings.ToLower(nvp.Name)] {
+			nvp.Value = redactedValue
+		}
+		redacted[i] = nvp
+	}
+	return
+}
+
+// redactURL redacts query parameters, leaving the rest of rawURL as is
+func (reporting *reportingYML) redactURL(rawURL string) string {
+	URL, err := url.Parse(rawURL)
+	if err != nil || URL.RawQuery == "" {
+		return rawURL
+	}
+	reporting.redact()
+	pairs := strings.Split(URL.RawQuery, "&")
+	for i, pair := range pairs {
+		key := strings.SplitN(pair, "=", 2)[0]
+		if name, err := url.QueryUnescape(key); err == nil && reporting.redacted[strings.ToLower(name)] {
+			pairs[i] = key + "=" + url.QueryEscape(redactedValue)
+		}
+	}
+	URL.RawQuery = strings.Join(pairs, "&")
+	return URL.String()
+}
+
+// redactCookies keeps cookies' names & attributes
+func redactCookies(cookies []harCookie) (redacted []harCookie) {
+	if cookies == nil {
+		return
+	}
+	redacted = make([]harCookie, len(cookies))
+	for i, cookie := range cookies {
+		cookie.Value = redactedValue
+		redacted[i] = cookie
+	}
+	return
+}
+
+func (reporting *reportingYML) body(text string) string {
+	if text == "" {
+		return text
+	}
+
+	switch reporting.Level {
+	case reportNoBodies:
+		return ""
+	case reportShapes:
+		text = shapeOfBody(text)
+	case reportHashes:
+		sum := sha256.Sum256([]byte(text))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	if max := reporting.MaxBodySize; max != 0 && len(text) > max {
+		cut := max
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text = text[:cut] + truncatedMarker
+	}
+	return text
+}
+
+// shapeOfBody describes a JSON body without its values
+func shapeOfBody(text string) string {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(text), &doc); err != nil {
+		return fmt.Sprintf("<%d bytes, not JSON>", len(text))
+	}
+	shape, err := json.Marshal(shapeOf(doc))
+	if err != nil {
+		log.Println("[ERR]", err)
+		return ""
+	}
+	return string(shape)
+}
+
+// shapeOf replaces values with their JSON type.
+// Arrays are described by the shape of their first element.
+func shapeOf(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		shape := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			shape[key] = shapeOf(val)
+		}
+		return shape
+	case []interface{}:
+		if len(v) == 0 {
+			return []interface{}{}
+		}
+		return []interface{}{shapeOf(v[0])}
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	default:
+		return "null"
+	}
+}
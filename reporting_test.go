@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"reflect"
+	"testing"
+
+	"github.com/sebcat/har"
+)
+
+func TestReportingBody(t *testing.T) {
+	body := `{"id": 42, "name": "Zoë", "tags": ["a", "b"], "meta": null}`
+	for _, test := range []struct {
+		reporting reportingYML
+		expected  string
+	}{
+		{reportingYML{Level: reportFull}, body},
+		{reportingYML{Level: reportNoBodies}, ""},
+		{reportingYML{Level: reportShapes}, `{"id":"number","meta":"null","name":"string","tags":["string"]}`},
+		{reportingYML{Level: reportHashes}, "sha256:" + hexSHA256([]byte(body))},
+		{reportingYML{Level: reportFull, MaxBodySize: 23}, `{"id": 42, "name": "Zo` + truncatedMarker},
+		{reportingYML{Level: reportShapes, MaxBodySize: 7}, `{"id":"` + truncatedMarker},
+	} {
+		if got := test.reporting.body(body); got != test.expected {
+			t.Errorf("%+v: expected %q, got %q", test.reporting, test.expected, got)
+		}
+	}
+
+	shapes := reportingYML{Level: reportShapes}
+	if got := shapes.body("<html/>"); got != "<7 bytes, not JSON>" {
+		t.Errorf("unexpected shape of HTML: %q", got)
+	}
+}
+
+func TestReportingLeavesEntryAsRecorded(t *testing.T) {
+	newEntry := func() harEntry {
+		entry := &harLogEntry{}
+		entry.Request.URL = "http://localhost/items?access_token=s3cr3t&q=1&X-Api-Key=s3cr3t"
+		entry.Request.QueryString = []har.NVP{
+			{Name: "access_token", Value: "s3cr3t"}, {Name: "q", Value: "1"}, {Name: "X-Api-Key", Value: "s3cr3t"},
+		}
+		entry.Request.Headers = []har.NVP{{Name: "authorization", Value: "s3cr3t"}, {Name: "X-Api-Key", Value: "s3cr3t"}}
+		entry.Request.Cookies = []harCookie{{Name: "session", Value: "s3cr3t"}}
+		entry.Request.PostData = &har.PostData{Text: "secret"}
+		entry.Response.Headers = []har.NVP{{Name: "Set-Cookie", Value: "session=s3cr3t"}, {Name: "X-Seen", Value: "1"}}
+		entry.Response.Cookies = []harCookie{{Name: "session", Value: "s3cr3t", HTTPOnly: true}}
+		entry.Response.Content.Text = "secret"
+		return entry
+	}
+
+	for _, level := range []reportingLevel{reportFull, reportNoBodies} {
+		entry := newEntry()
+		reporting := reportingYML{Level: level}
+		reporting.redact("X-Api-Key")
+		reported := reporting.report(entry)
+
+		if !reflect.DeepEqual(entry, newEntry()) {
+			t.Errorf("%s: expected the recorded entry to be left alone, got %+v", level, entry)
+		}
+
+		expectedURL := "http://localhost/items?access_token=%5Bredacted%5D&q=1&X-Api-Key=%5Bredacted%5D"
+		if reported.Request.URL != expectedURL {
+			t.Errorf("%s: expected URL %s, got %s", level, expectedURL, reported.Request.URL)
+		}
+		expectedQuery := []har.NVP{
+			{Name: "access_token", Value: redactedValue}, {Name: "q", Value: "1"}, {Name: "X-Api-Key", Value: redactedValue},
+		}
+		if !reflect.DeepEqual(reported.Request.QueryString, expectedQuery) {
+			t.Errorf("%s: expected query %+v, got %+v", level, expectedQuery, reported.Request.QueryString)
+		}
+		expectedHeaders := []har.NVP{{Name: "authorization", Value: redactedValue}, {Name: "X-Api-Key", Value: redactedValue}}
+		if !reflect.DeepEqual(reported.Request.Headers, expectedHeaders) {
+			t.Errorf("%s: expected request headers %+v, got %+v", level, expectedHeaders, reported.Request.Headers)
+		}
+		expectedHeaders = []har.NVP{{Name: "Set-Cookie", Value: redactedValue}, {Name: "X-Seen", Value: "1"}}
+		if !reflect.DeepEqual(reported.Response.Headers, expectedHeaders) {
+			t.Errorf("%s: expected response headers %+v, got %+v", level, expectedHeaders, reported.Response.Headers)
+		}
+		if reported.Request.Cookies[0].Value != redactedValue || reported.Response.Cookies[0] != (harCookie{Name: "session", Value: redactedValue, HTTPOnly: true}) {
+			t.Errorf("%s: expected redacted cookies, got %+v and %+v", level, reported.Request.Cookies, reported.Response.Cookies)
+		}
+
+		expectedBody := map[reportingLevel]string{reportFull: "secret", reportNoBodies: ""}[level]
+		if reported.Request.PostData.Text != expectedBody || reported.Response.Content.Text != expectedBody {
+			t.Errorf("%s: expected bodies %q, got %+v", level, expectedBody, reported)
+		}
+	}
+}
+
+func TestReportingBinaryBody(t *testing.T) {
+	data := []byte{0x89, 'P', 'N', 'G', 0xff, 0x00, 0x01, 0x02, 0x03}
+	binary := &harLogEntry{}
+	binary.Response.Content = harContent{
+		Size:     int64(len(data)),
+		Text:     base64.StdEncoding.EncodeToString(data),
+		Encoding: "base64",
+	}
+
+	reporting := reportingYML{Level: reportFull, MaxBodySize: 5}
+	content := reporting.report(binary).Response.Content
+	if content.Encoding != "base64" || content.Comment != "truncated to 5 of 9 bytes" {
+		t.Errorf("unexpected truncated content %+v", content)
+	}
+	if truncated, err := base64.StdEncoding.DecodeString(content.Text); err != nil || !bytes.Equal(truncated, data[:5]) {
+		t.Errorf("expected the first 5 bytes, got %q (%v)", content.Text, err)
+	}
+
+	text := &harLogEntry{}
+	text.Response.Content = harContent{Size: int64(len(data)), Text: string(data)}
+	hashes := reportingYML{Level: reportHashes}
+	content = hashes.report(binary).Response.Content
+	if expected := hashes.report(text).Response.Content.Text; content.Text != expected || content.Encoding != "" {
+		t.Errorf("expected the hash of the bytes %s, got %+v", expected, content)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// reproTest is the last failing test of a run: once shrinking is over,
+// the smallest known way to trigger the bug.
+type reproTest struct {
+	V           uint         `json:"v"`
+	T           uint         `json:"t"`
+	HARRequests []harRequest `json:"har_reqs"`
+}
+
+// repro collects the requests of the test being run
+var repro reproTest
+
+func collectRepro(at lane, harReq harRequest) {
+	if at.T != repro.T {
+		repro = reproTest{T: at.T}
+	}
+	repro.HARRequests = append(repro.HARRequests, harReq)
+}
+
+// maybeSaveRepro keeps the test that just ran if it failed.
+// It is best effort: failing to save should not stop a run.
+func maybeSaveRepro(cmd *simpleCmd) {
+	if cmd.Passed == nil || *cmd.Passed || len(repro.HARRequests) == 0 {
+		return
+	}
+
+	repro.V = protocolV
+	data, err := json.Marshal(&repro)
+	if err != nil {
+		log.Println("[ERR]", err)
+		return
+	}
+
+	tmp := reproID() + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		log.Println("[ERR]", err)
+		return
+	}
+	if err = os.Rename(tmp, reproID()); err != nil {
+		log.Println("[ERR]", err)
+	}
+}
+
+func loadRepro() (test *reproTest, err error) {
+	data, err := ioutil.ReadFile(reproID())
+	if err != nil {
+		log.Println("[ERR]", err)
+		if os.IsNotExist(err) {
+			fmt.Println("There is no failing test to reproduce here.")
+		}
+		return
+	}
+
+	test = &reproTest{}
+	if err = json.Unmarshal(data, test); err != nil {
+		log.Println("[ERR]", err)
+		return
+	}
+
+	if !isSupportedV(test.V) || len(test.HARRequests) == 0 {
+		err = fmt.Errorf("unusable repro file %s", reproID())
+		log.Println("[ERR]", err)
+		fmt.Println(err)
+	}
+	return
+}
+
+// doRepro resets the SUT then runs the last failing test's requests,
+// showing each of them along with its response.
+func doRepro() int {
+	test, err := loadRepro()
+	if err != nil {
+		return 1
+	}
+
+	cfg, code := setupLocalRun()
+	if code != 0 {
+		return code
+	}
+	defer ensureDeleted(envID())
+	defer closeWire(cfg)
+
+	if cmdRep := executeScript(cfg, kindStart); cmdRep.Failed {
+		return retryOrReportThenCleanup(cfg, fmt.Errorf("start failed"))
+	}
+	if len(cfg.Start) == 0 {
+		if err := maybeFinalizeConf(cfg, kindStart); err != nil {
+			return retryOrReportThenCleanup(cfg, err)
+		}
+	}
+	if cmdRep := executeScript(cfg, kindReset); cmdRep.Failed {
+		return retryOrReportThenCleanup(cfg, fmt.Errorf("reset failed"))
+	}
+
+	fmt.Printf("Reproducing test #%d in %d requests\n", test.T, len(test.HARRequests))
+	for i, harReq := range test.HARRequests {
+		cmd := &reqCmd{
+			V:          test.V,
+			Cmd:        kindReq,
+			Lane:       lane{T: test.T, R: uint(i + 1)},
+			HARRequest: harReq,
+		}
+
+		rep, err := cmd.Exec(cfg)
+		if err != nil {
+			return retryOrReportThenCleanup(cfg, err)
+		}
+		printRepro(cmd, rep)
+	}
+	clearHAR()
+
+	if cmdRep := executeScript(cfg, kindStop); cmdRep.Failed {
+		return 7
+	}
+	return 0
+}
+
+func printRepro(cmd *reqCmd, rep []byte) {
+	fmt.Printf("\n▲ %d.%d: %s %s\n", cmd.Lane.T, cmd.Lane.R,
+		cmd.HARRequest.Method, cmd.HARRequest.URL)
+	for _, header := range cmd.HARRequest.Headers {
+		fmt.Printf("  %s: %s\n", header.Name, header.Value)
+	}
+	if postData := cmd.HARRequest.PostData; postData != nil && postData.Text != "" {
+		fmt.Printf("  %s\n", postData.Text)
+	}
+
+	got, err := replayedReqs(kindReq, rep)
+	if err != nil {
+		return
+	}
+	fmt.Printf("▼ %s\n", got[0].describe())
+	if got[0].HARRep != nil && got[0].HARRep.Response.Content.Text != "" {
+		fmt.Printf("  %s\n", got[0].HARRep.Response.Content.Text)
+	}
+	for _, violation := range got[0].Violations {
+		fmt.Printf("✗ %s\n", violation)
+	}
+}
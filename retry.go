@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"time"
+)
+
+const (
+	retryAttempts         = 6
+	xIdempotencyKeyHeader = "X-Idempotency-Key"
+)
+
+var (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+	retryRand      = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// doWithRetries sends r through clientUtils and reads the response body,
+// retrying transient failures with a bounded and jittered exponential backoff.
+// A request that is not idempotent is only retried when the server
+// cannot have acted on it.
+// The returned response is the last one received, even if it is a 5xx.
+func doWithRetries(r *http.Request, idempotent bool) (resp *http.Response, body []byte, err error) {
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && r.GetBody != nil {
+			if r.Body, err = r.GetBody(); err != nil {
+				log.Println("[ERR]", err)
+				return
+			}
+		}
+
+		var wrote bool
+		trace := &httptrace.ClientTrace{
+			WroteRequest: func(httptrace.WroteRequestInfo) { wrote = true },
+		}
+		req := r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+
+		start := time.Now()
+		if resp, err = clientUtils.Do(req); err == nil {
+			body, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		log.Printf("[DBG] ❙ %dμs\n", time.Since(start)/time.Microsecond)
+
+		if attempt == retryAttempts || !isTransient(resp, err) {
+			return
+		}
+		if !idempotent && !wasTurnedAway(resp, err, wrote) {
+			return
+		}
+
+		var why string
+		if err != nil {
+			why = err.Error()
+		} else {
+			why = resp.Status
+		}
+		delay := backoff(attempt)
+		log.Printf("[ERR] attempt %d/%d at %s %s failed: %s (retrying in %s)\n",
+			attempt, retryAttempts, r.Method, r.URL, why, delay)
+		time.Sleep(delay)
+	}
+}
+
+func isTransient(resp *http.Response, err error) bool {
+	if err != nil {
+		return !isCertificateError(err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isCertificateError looks for certificate errors past the errors wrapping them
+func isCertificateError(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError:
+			return true
+		case *url.Error:
+			err = e.Err
+		case unwrapper:
+			err = e.Unwrap()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// unwrapper is implemented by errors wrapping a cause,
+// such as the tls.CertificateVerificationError of newer Go versions
+type unwrapper interface {
+	Unwrap() error
+}
+
+// wasTurnedAway tells whether a failed request surely had no effect:
+// either it was never fully sent or the server refused to handle it.
+func wasTurnedAway(resp *http.Response, err error, wrote bool) bool {
+	if err != nil {
+		return !wrote
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// backoff picks a random delay of up to retryBaseDelay * 2^(attempt-1),
+// capped by retryMaxDelay ("full jitter").
+func backoff(attempt int) time.Duration {
+	ceiling := retryBaseDelay << uint(attempt-1)
+	if ceiling <= 0 || ceiling > retryMaxDelay {
+		ceiling = retryMaxDelay
+	}
+	return time.Duration(retryRand.Int63n(int64(ceiling))) + time.Millisecond
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDoWithRetriesOnlyResendsIdempotentRequestsAfterHangups(t *testing.T) {
+	defer fastRetries()()
+
+	var hits int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		// Hang up once the request was received
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer server.Close()
+
+	for idempotent, expected := range map[bool]int64{true: retryAttempts, false: 1} {
+		atomic.StoreInt64(&hits, 0)
+		r, err := http.NewRequest(http.MethodPut, server.URL, bytes.NewBufferString("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = doWithRetries(r, idempotent); err == nil {
+			t.Errorf("idempotent=%v: expected an error", idempotent)
+		}
+		if got := atomic.LoadInt64(&hits); got != expected {
+			t.Errorf("idempotent=%v: expected %d attempts, got %d", idempotent, expected, got)
+		}
+	}
+}
+
+func TestDoWithRetriesResendsRequestsTurnedAway(t *testing.T) {
+	defer fastRetries()()
+
+	var hits int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&hits, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	r, err := http.NewRequest(http.MethodPut, server.URL, bytes.NewBufferString("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _, err := doWithRetries(r, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusCreated || atomic.LoadInt64(&hits) != 3 {
+		t.Errorf("expected 201 after 3 attempts, got %s after %d", resp.Status, hits)
+	}
+}
+
+type wrappedErr struct{ cause error }
+
+func (e wrappedErr) Error() string { return "wrapped: " + e.cause.Error() }
+func (e wrappedErr) Unwrap() error { return e.cause }
+
+func TestIsTransientGivesUpOnBadCertificates(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(sutOK))
+	defer server.Close()
+	_, err := http.Get(server.URL)
+	if err == nil {
+		t.Fatal("expected an untrusted certificate")
+	}
+
+	for _, err := range []error{
+		err,
+		&url.Error{Op: "Get", URL: server.URL, Err: wrappedErr{x509.UnknownAuthorityError{}}},
+		wrappedErr{x509.HostnameError{Certificate: &x509.Certificate{}, Host: "example.com"}},
+	} {
+		if isTransient(nil, err) {
+			t.Errorf("expected %v not to be transient", err)
+		}
+	}
+	if !isTransient(nil, wrappedErr{io.ErrUnexpectedEOF}) {
+		t.Error("expected a hang up to be transient")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// session holds what is needed to reattach to a server-side fuzzing session.
+// V is the negotiated protocol version.
+// Cmd is the last command received: the server acknowledged the reply to
+// the command before it, but may still be waiting for this one's.
+type session struct {
+	V             uint            `json:"v"`
+	AuthToken     string          `json:"auth_token"`
+	LastLane      lane            `json:"last_lane"`
+	ShrinkingFrom lane            `json:"shrinking_from"`
+	TotalR        uint            `json:"total_r"`
+	LastReplySeq  uint            `json:"last_reply_seq"`
+	Cmd           json.RawMessage `json:"cmd"`
+}
+
+// saveSession is best effort: failing to save should not stop a run
+func saveSession(cfg *ymlCfg, cmdJSON []byte) {
+	data, err := json.Marshal(&session{
+		V:             protocolV,
+		AuthToken:     cfg.AuthToken,
+		LastLane:      lastLane,
+		ShrinkingFrom: shrinkingFrom,
+		TotalR:        totalR,
+		LastReplySeq:  lastReplySeq,
+		Cmd:           cmdJSON,
+	})
+	if err != nil {
+		log.Println("[ERR]", err)
+		return
+	}
+
+	tmp := sessionID() + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		log.Println("[ERR]", err)
+		return
+	}
+	if err = os.Rename(tmp, sessionID()); err != nil {
+		log.Println("[ERR]", err)
+	}
+}
+
+func loadSession() (sess *session, err error) {
+	data, err := ioutil.ReadFile(sessionID())
+	if err != nil {
+		log.Println("[ERR]", err)
+		if os.IsNotExist(err) {
+			fmt.Println("There is no interrupted session to resume here.")
+		}
+		return
+	}
+
+	sess = &session{}
+	if err = json.Unmarshal(data, sess); err != nil {
+		log.Println("[ERR]", err)
+		return
+	}
+
+	if !isSupportedV(sess.V) || sess.AuthToken == "" || len(sess.Cmd) == 0 {
+		err = fmt.Errorf("unusable session file %s", sessionID())
+		log.Println("[ERR]", err)
+		fmt.Println(err)
+	}
+	return
+}
+
+func resumeDialogue() (cfg *ymlCfg, cmd aCmd, err error) {
+	sess, err := loadSession()
+	if err != nil {
+		return
+	}
+
+	yml, err := readYML()
+	if err != nil {
+		return
+	}
+
+	if cfg, err = newCfg(yml); err != nil {
+		return
+	}
+	cfg.AuthToken = sess.AuthToken
+	protocolV = sess.V
+	lastLane, shrinkingFrom, totalR = sess.LastLane, sess.ShrinkingFrom, sess.TotalR
+	lastReplySeq = sess.LastReplySeq
+	log.Printf("[NFO] resuming session %+v\n", sess)
+	warnIfAssertionsIgnored(cfg)
+
+	if cmd, err = unmarshalCmd(sess.Cmd); err != nil {
+		return
+	}
+	recordCmd(sess.Cmd)
+
+	// The SUT may have gone down with the previous run
+	if kind := cmd.Kind(); kind != kindStart && kind != kindDone {
+		if cmdRep := executeScript(cfg, kindStart); cmdRep.Failed {
+			err = fmt.Errorf("failed to restart before resuming")
+			return
+		}
+		if len(cfg.Start) == 0 {
+			if err = maybeFinalizeConf(cfg, kindStart); err != nil {
+				return
+			}
+		}
+	}
+
+	fmt.Printf("Resuming after %d tests totalling %d requests\n", lastLane.T, totalR)
+	return
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	timeoutSigner = 10 * time.Second
+	sigV4Algo     = "AWS4-HMAC-SHA256"
+	sigV4Date     = "20060102T150405Z"
+)
+
+// signingYML describes how to sign every request, once its URL & auth are final.
+// All values but Exec may use {{ env "VAR" }}.
+type signingYML struct {
+	HMAC  *hmacSigningYML  `yaml:"hmac"`
+	SigV4 *sigV4SigningYML `yaml:"aws_sigv4"`
+	// Exec is given the request as HAR on stdin and
+	// outputs headers to add, one "Name: value" per line
+	Exec string `yaml:"exec"`
+}
+
+// hmacSigningYML signs method, path & query, timestamp and body, one per line
+type hmacSigningYML struct {
+	Secret          string `yaml:"secret"`
+	Algorithm       string `yaml:"algorithm"`
+	Header          string `yaml:"header"`
+	TimestampHeader string `yaml:"timestamp_header"`
+}
+
+type sigV4SigningYML struct {
+	Region          string `yaml:"region"`
+	Service         string `yaml:"service"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	SessionToken    string `yaml:"session_token"`
+}
+
+func (signing *signingYML) isSet() bool {
+	return signing.HMAC != nil || signing.SigV4 != nil || signing.Exec != ""
+}
+
+// headerNames lists the headers signatures get sent in, but Exec's
+func (signing *signingYML) headerNames() (names []string) {
+	if signing.HMAC != nil {
+		header, _ := signing.HMAC.headers()
+		names = append(names, header)
+	}
+	if signing.SigV4 != nil {
+		names = append(names, authorizationHeader, "X-Amz-Security-Token")
+	}
+	return
+}
+
+// finalizeSigning resolves the env templates of cfg.Signing
+func finalizeSigning(cfg *ymlCfg) (err error) {
+	final := &signingYML{Exec: cfg.Signing.Exec}
+	if h := cfg.Signing.HMAC; h != nil {
+		hmacSigning := *h
+		if err = unstacheAll(&hmacSigning.Secret); err != nil {
+			return
+		}
+		final.HMAC = &hmacSigning
+	}
+	if s := cfg.Signing.SigV4; s != nil {
+		sigV4 := *s
+		if err = unstacheAll(&sigV4.Region, &sigV4.Service, &sigV4.AccessKeyID,
+			&sigV4.SecretAccessKey, &sigV4.SessionToken); err != nil {
+			return
+		}
+		final.SigV4 = &sigV4
+	}
+	cfg.FinalSigning = final
+	return
+}
+
+func (h *hmacSigningYML) check() (err error) {
+	switch h.Algorithm {
+	case "", "sha256", "sha512":
+	default:
+		err = fmt.Errorf("unsupported HMAC algorithm %q: pick sha256 or sha512", h.Algorithm)
+		log.Println("[ERR]", err)
+		fmt.Println(err)
+	}
+	return
+}
+
+// signRequest runs the configured signers, in order: HMAC, SigV4 then Exec
+func (cmd *reqCmd) signRequest(cfg *ymlCfg, r *http.Request) (err error) {
+	signing := cfg.FinalSigning
+	if signing == nil {
+		return
+	}
+
+	var body []byte
+	if postData := cmd.HARRequest.PostData; postData != nil {
+		body = []byte(postData.Text)
+	}
+	now := time.Now().UTC()
+
+	if signing.HMAC != nil {
+		signing.HMAC.sign(r, body, now)
+	}
+	if signing.SigV4 != nil {
+		signing.SigV4.sign(r, body, now)
+	}
+	if signing.Exec != "" {
+		var names []string
+		names, err = cmd.signWithExec(signing.Exec, r)
+		cfg.Reporting.redact(names...)
+	}
+	return
+}
+
+func (h *hmacSigningYML) headers() (header, timestampHeader string) {
+	header, timestampHeader = h.Header, h.TimestampHeader
+	if header == "" {
+		header = "X-Signature"
+	}
+	if timestampHeader == "" {
+		timestampHeader = "X-Timestamp"
+	}
+	return
+}
+
+func (h *hmacSigningYML) sign(r *http.Request, body []byte, now time.Time) {
+	header, timestampHeader := h.headers()
+	newHash := sha256.New
+	if h.Algorithm == "sha512" {
+		newHash = sha512.New
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(newHash, []byte(h.Secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", r.Method, r.URL.RequestURI(), timestamp)
+	mac.Write(body)
+
+	r.Header.Set(timestampHeader, timestamp)
+	r.Header.Set(header, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// sign implements AWS Signature Version 4, signing the host,
+// content type and x-amz-* headers.
+func (s *sigV4SigningYML) sign(r *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format(sigV4Date)
+	date := amzDate[:8]
+	payloadHash := hexSHA256(body)
+
+	r.Header.Set("X-Amz-Date", amzDate)
+	if s.SessionToken != "" {
+		r.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+	if s.Service == "s3" {
+		r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	signed := map[string]string{"host": host}
+	for name, values := range r.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			signed[lower] = strings.Join(strings.Fields(strings.Join(values, ",")), " ")
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, signed[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		s.canonicalURI(r.URL),
+		sigV4CanonicalQuery(r.URL),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, s.Region, s.Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		sigV4Algo,
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := []byte("AWS4" + s.SecretAccessKey)
+	for _, part := range []string{date, s.Region, s.Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	r.Header.Set(authorizationHeader, fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algo, s.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalURI encodes path segments twice, except for S3
+func (s *sigV4SigningYML) canonicalURI(URL *url.URL) string {
+	path := URL.EscapedPath()
+	if s.Service == "s3" {
+		path = URL.Path
+	}
+	if path == "" {
+		return "/"
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = sigV4Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// sigV4CanonicalQuery sorts encoded pairs by key then value
+func sigV4CanonicalQuery(URL *url.URL) string {
+	var pairs [][2]string
+	for key, values := range URL.Query() {
+		for _, value := range values {
+			pairs = append(pairs, [2]string{sigV4Escape(key), sigV4Escape(value)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+
+	joined := make([]string, len(pairs))
+	for i, pair := range pairs {
+		joined[i] = pair[0] + "=" + pair[1]
+	}
+	return strings.Join(joined, "&")
+}
+
+// sigV4Escape percent-encodes all but unreserved characters
+func sigV4Escape(str string) string {
+	var buf bytes.Buffer
+	for _, c := range []byte(str) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signWithExec adds the headers shellCmd outputs, returning their names
+func (cmd *reqCmd) signWithExec(shellCmd string, r *http.Request) (names []string, err error) {
+	input, err := json.Marshal(cmd.HARRequest)
+	if err != nil {
+		log.Println("[ERR]", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutSigner)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	exe := exec.CommandContext(ctx, shell(), "-c", shellCmd)
+	exe.Stdin = bytes.NewReader(input)
+	exe.Stdout = &stdout
+	exe.Stderr = &stderr
+	log.Printf("[DBG] within %s $ %s\n", timeoutSigner, shellCmd)
+
+	if err = exe.Run(); err != nil {
+		log.Println("[ERR]", stderr.String()+"\n"+err.Error())
+		fmt.Printf("Signing command failed with %s\n", err)
+		fmt.Printf("Command:\n%s\n", shellCmd)
+		fmt.Printf("Stderr:\n%s\n", stderr.String())
+		return
+	}
+
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		colon := strings.Index(line, ":")
+		if colon <= 0 {
+			err = fmt.Errorf("signing command output %q is not a header", line)
+			log.Println("[ERR]", err)
+			fmt.Println(err)
+			return
+		}
+		name := strings.TrimSpace(line[:colon])
+		r.Header.Set(name, strings.TrimSpace(line[colon+1:]))
+		names = append(names, name)
+	}
+	return
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sebcat/har"
+)
+
+// From the AWS Signature Version 4 test suite
+func TestSigV4Suite(t *testing.T) {
+	for name, test := range map[string]struct {
+		query     string
+		signature string
+	}{
+		"get-vanilla":                      {"", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		"get-vanilla-query-order-key-case": {"Param2=value2&Param1=value1", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+		"get-vanilla-query-order-key":      {"Param1=value2&Param1=Value1", "eedbc4e291e521cf13422ffca22be7d2eb8146eecf653089df300a15b2382bd1"},
+		"get-vanilla-query-order-value":    {"Param1=value2&Param1=value1", "5772eed61e12b33fae39ee5e7012498b51d56abc0abb7c60486157bd471c4694"},
+	} {
+		r, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/?"+test.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer := &sigV4SigningYML{
+			Region:          "us-east-1",
+			Service:         "service",
+			AccessKeyID:     "AKIDEXAMPLE",
+			SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		}
+		signer.sign(r, nil, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+		expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=host;x-amz-date, " +
+			"Signature=" + test.signature
+		if got := r.Header.Get(authorizationHeader); got != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, got)
+		}
+		if got := r.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+			t.Errorf("%s: expected X-Amz-Date 20150830T123600Z, got %q", name, got)
+		}
+	}
+}
+
+func TestSigV4CanonicalQuerySortsKeysFirst(t *testing.T) {
+	URL, err := url.Parse("https://example.amazonaws.com/?a-b=1&a=2&a=1&b=%20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := sigV4CanonicalQuery(URL), "a=1&a=2&a-b=1&b=%20"; got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestHMACSign(t *testing.T) {
+	r, err := http.NewRequest(http.MethodPost, "http://localhost/items?q=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &hmacSigningYML{Secret: "s3cr3t"}
+	signer.sign(r, []byte(`{}`), time.Unix(1500000000, 0))
+
+	expected := "d9c6f192f359f275f04b044a0e7b591941cd7432c1491cdf5943add963895ea0"
+	if got := r.Header.Get("X-Signature"); got != expected {
+		t.Errorf("unexpected signature %q", got)
+	}
+	if got := r.Header.Get("X-Timestamp"); got != "1500000000" {
+		t.Errorf("expected X-Timestamp 1500000000, got %q", got)
+	}
+}
+
+func TestSignWithExec(t *testing.T) {
+	cmd := &reqCmd{HARRequest: &har.Request{Method: "GET", URL: "http://localhost/"}}
+	r, err := http.NewRequest(http.MethodGet, "http://localhost/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := cmd.signWithExec(`grep -q '"method":"GET"' && printf 'X-Sig: 42\n\nX-Other:  a:b \n'`, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"X-Sig", "X-Other"}) ||
+		r.Header.Get("X-Sig") != "42" || r.Header.Get("X-Other") != "a:b" {
+		t.Errorf("unexpected headers %v from %q", r.Header, names)
+	}
+
+	if _, err = cmd.signWithExec(`echo not a header`, r); err == nil {
+		t.Error("expected an error for output that is not a header")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	capStream      = "stream"
+	streamProtocol = "fuzzymonkey-ndjson/1"
+)
+
+// stream, when not nil, replaces nextPOST round trips.
+// Upon any failure the dialogue falls back to nextPOST.
+var stream *cmdStream
+
+// streamTimeout bounds the upgrade then each exchange over the stream
+var streamTimeout = timeoutLong
+
+// streamFrame carries a reply over the stream.
+// The server answers each frame with the next command on a single line.
+type streamFrame struct {
+	Key string          `json:"key"`
+	Rep json.RawMessage `json:"rep"`
+}
+
+type cmdStream struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// maybeOpenStream upgrades a connection to the server into a
+// bidirectional stream of newline-delimited JSON, if the server offers it.
+func maybeOpenStream(cfg *ymlCfg) {
+	if !hasServerCapability(capStream) {
+		return
+	}
+
+	r, err := http.NewRequest(http.MethodGet, streamURL, nil)
+	if err != nil {
+		log.Println("[ERR]", err)
+		return
+	}
+
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", streamProtocol)
+	r.Header.Set("User-Agent", binTitle)
+	r.Header.Set(xAuthTokenHeader, cfg.AuthToken)
+
+	// net/http only hands out upgraded connections from Go 1.12 on
+	log.Printf("[DBG] 🡱  GET %s (upgrade to %s)\n", streamURL, streamProtocol)
+	conn, err := dialStream(r.URL)
+	if err != nil {
+		log.Println("[ERR]", err)
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(streamTimeout))
+	if err = r.Write(conn); err != nil {
+		conn.Close()
+		log.Println("[ERR]", err)
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, r)
+	if err != nil {
+		conn.Close()
+		log.Println("[ERR]", err)
+		return
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		conn.Close()
+		log.Println("[ERR]", newStatusError(http.StatusSwitchingProtocols, resp.Status))
+		return
+	}
+
+	log.Println("[NFO] streaming commands")
+	stream = &cmdStream{conn: conn, reader: reader}
+}
+
+// dialStream connects to the server the same way clientUtils would,
+// proxies aside.
+func dialStream(u *url.URL) (conn net.Conn, err error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	host := u.Hostname()
+	if u.Scheme != "https" {
+		return dialer.Dial("tcp", net.JoinHostPort(host, portOr(u, "80")))
+	}
+
+	tlsConfig := &tls.Config{}
+	if transport, ok := clientUtils.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+		tlsConfig = transport.TLSClientConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	return tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, portOr(u, "443")), tlsConfig)
+}
+
+func portOr(u *url.URL, port string) string {
+	if p := u.Port(); p != "" {
+		return p
+	}
+	return port
+}
+
+func closeStream() {
+	if stream != nil {
+		stream.conn.Close()
+		stream = nil
+	}
+}
+
+func (s *cmdStream) exchange(key string, payload []byte) (rep []byte, err error) {
+	frame, err := json.Marshal(&streamFrame{Key: key, Rep: payload})
+	if err != nil {
+		log.Println("[ERR]", err)
+		return
+	}
+
+	log.Printf("[DBG] 🡱  stream\n  🡱  %s\n", frame)
+	start := time.Now()
+	if err = s.conn.SetDeadline(start.Add(streamTimeout)); err != nil {
+		log.Println("[ERR]", err)
+		return
+	}
+	if _, err = s.conn.Write(append(frame, '\n')); err != nil {
+		log.Println("[ERR]", err)
+		return
+	}
+
+	if rep, err = s.reader.ReadBytes('\n'); err != nil {
+		log.Println("[ERR]", err)
+		return
+	}
+	log.Printf("[DBG] ❙ %dμs\n", time.Since(start)/time.Microsecond)
+	log.Printf("[DBG]\n  🡳  %s\n", rep)
+
+	if len(rep) < 2 {
+		err = fmt.Errorf("empty frame received")
+		log.Println("[ERR]", err)
+	}
+	return
+}
+
+// nextCmdJSON sends a reply and gets the next command,
+// over the stream if there is one and through nextPOST otherwise.
+func nextCmdJSON(cfg *ymlCfg, key string, payload []byte) (rep []byte, err error) {
+	if stream != nil {
+		if rep, err = stream.exchange(key, payload); err == nil {
+			return
+		}
+		log.Println("[NFO] stream broke, falling back to request/response")
+		closeStream()
+	}
+	return nextPOST(cfg, key, payload)
+}
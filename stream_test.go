@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStreamExchangeTimesOut(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n")
+		fmt.Fprintf(rw, "Connection: Upgrade\r\nUpgrade: %s\r\n\r\n", streamProtocol)
+		rw.Flush()
+		// Never answer
+		<-done
+	}))
+	defer server.Close()
+
+	oldCapabilities, oldStreamURL, oldTimeout := serverCapabilities, streamURL, streamTimeout
+	serverCapabilities, streamURL, streamTimeout = []string{capStream}, server.URL, 50*time.Millisecond
+	defer func() { serverCapabilities, streamURL, streamTimeout = oldCapabilities, oldStreamURL, oldTimeout }()
+
+	maybeOpenStream(&ymlCfg{})
+	if stream == nil {
+		t.Fatal("expected a stream")
+	}
+	defer closeStream()
+
+	start := time.Now()
+	if _, err := stream.exchange("1", []byte(`{}`)); err == nil {
+		t.Error("expected a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("exchange took %s", elapsed)
+	}
+}
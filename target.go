@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	schemeUnix = "unix"
+	// unixHost is the Host of requests sent over a Unix socket
+	unixHost = "localhost"
+
+	// http2Auto negotiates HTTP/2 over TLS, the default
+	http2Auto = "auto"
+	// http2H2C talks HTTP/2 in cleartext, without negotiating it first
+	http2H2C = "h2c"
+	// http2Off sticks to HTTP/1.1
+	http2Off = "off"
+)
+
+// targetRoundTripper is an *http.Transport or, for h2c, an *http2.Transport
+type targetRoundTripper interface {
+	http.RoundTripper
+	CloseIdleConnections()
+}
+
+// targetURL is where requests are sent: target.url when set,
+// otherwise documentation's host & port.
+// Unix sockets are given as unix:///path/to/the.sock
+func (cfg *ymlCfg) targetURL() (target *url.URL, err error) {
+	if cfg.FinalTarget == "" {
+		host := strings.TrimSuffix(strings.TrimPrefix(cfg.FinalHost, "["), "]")
+		target = &url.URL{Host: net.JoinHostPort(host, cfg.FinalPort)}
+		return
+	}
+
+	if target, err = url.Parse(cfg.FinalTarget); err != nil {
+		log.Println("[ERR]", err)
+		fmt.Printf("Could not parse target URL '%s'\n", cfg.FinalTarget)
+		return
+	}
+
+	switch target.Scheme {
+	case "http", "https":
+		if target.Host == "" {
+			err = fmt.Errorf("target URL %q has no host", cfg.FinalTarget)
+		}
+	case schemeUnix:
+		if target.Path == "" {
+			err = fmt.Errorf("target URL %q has no socket path", cfg.FinalTarget)
+		}
+	default:
+		err = fmt.Errorf("target URL %q should be http://, https:// or unix://", cfg.FinalTarget)
+	}
+	if err == nil && cfg.HTTP2 == http2H2C && target.Scheme == "https" {
+		err = fmt.Errorf("target URL %q should be http:// or unix:// for h2c", cfg.FinalTarget)
+	}
+	if err == nil && cfg.CaptureWire && cfg.HTTP2 != http2Off && target.Scheme == "https" {
+		err = fmt.Errorf("capture_wire cannot follow HTTP/2 over TLS: set target http2 to %s for %q (or use %s over http://)",
+			http2Off, cfg.FinalTarget, http2H2C)
+	}
+	if err != nil {
+		log.Println("[ERR]", err)
+		fmt.Println(err)
+	}
+	return
+}
+
+// targetTLSYML is how to talk TLS to the target
+type targetTLSYML struct {
+	CAFile     string `yaml:"ca_file"`
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	ServerName string `yaml:"server_name"`
+	Insecure   bool   `yaml:"insecure"`
+}
+
+// config is nil when the defaults do
+func (t *targetTLSYML) config() (tlsConfig *tls.Config, err error) {
+	if *t == (targetTLSYML{}) {
+		return
+	}
+
+	if tlsConfig, err = newTLSConfig(t.CAFile, t.CertFile, t.KeyFile); err != nil {
+		return
+	}
+	tlsConfig.ServerName = t.ServerName
+	if t.Insecure {
+		log.Println("[NFO] not verifying the target's certificates")
+		fmt.Println("Warning: the target's TLS certificates will not be verified")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return
+}
+
+// targetTimeoutsYML holds durations such as "1m30s"
+type targetTimeoutsYML struct {
+	Request        string `yaml:"request"`
+	Connect        string `yaml:"connect"`
+	ResponseHeader string `yaml:"response_header"`
+}
+
+// targetTimeouts bound each request to the target.
+// Zero means no timeout other than Request's.
+type targetTimeouts struct {
+	Request        time.Duration
+	Connect        time.Duration
+	ResponseHeader time.Duration
+}
+
+func (t *targetTimeoutsYML) parse() (timeouts targetTimeouts, err error) {
+	timeouts.Request = timeoutLong
+	for _, field := range []struct {
+		name  string
+		value string
+		into  *time.Duration
+	}{
+		{"request", t.Request, &timeouts.Request},
+		{"connect", t.Connect, &timeouts.Connect},
+		{"response_header", t.ResponseHeader, &timeouts.ResponseHeader},
+	} {
+		if field.value == "" {
+			continue
+		}
+		if *field.into, err = time.ParseDuration(field.value); err != nil {
+			log.Println("[ERR]", err)
+			fmt.Printf("Could not parse target timeout %s: '%s'\n", field.name, field.value)
+			return
+		}
+	}
+	return
+}
+
+// checkHTTP2 validates the target http2 setting
+func checkHTTP2(mode string) (err error) {
+	switch mode {
+	case "", http2Auto, http2H2C, http2Off:
+	default:
+		err = fmt.Errorf("unsupported target http2 %q: pick %s, %s or %s",
+			mode, http2Auto, http2H2C, http2Off)
+		log.Println("[ERR]", err)
+		fmt.Println(err)
+	}
+	return
+}
+
+// targetTransport is built once then shared by all tests,
+// unless each test should get fresh connections.
+func targetTransport(cfg *ymlCfg, target *url.URL) http.RoundTripper {
+	if cfg.Transport != nil {
+		if cfg.FreshConnections {
+			cfg.Transport.CloseIdleConnections()
+		}
+		return cfg.Transport
+	}
+
+	dialer := newTargetDialer(cfg)
+	transport := newTargetHTTPTransport(cfg, dialer)
+	if target.Scheme == schemeUnix {
+		socket := target.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+	if cfg.CaptureWire {
+		if wire, err := newWireCapture(wireID()); err == nil {
+			wire.capturingDials(transport)
+			cfg.Wire = wire
+		}
+	}
+
+	switch {
+	case cfg.HTTP2 == http2H2C:
+		cfg.Transport = h2cTransport(transport)
+		return cfg.Transport
+	case cfg.HTTP2 == http2Off:
+		// A non-nil map disables HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	case cfg.Wire != nil:
+		// targetURL only lets wire capture through without TLS, where auto means HTTP/1.1
+	default:
+		if err := http2.ConfigureTransport(transport); err != nil {
+			log.Println("[ERR]", err)
+		}
+	}
+
+	cfg.Transport = transport
+	return transport
+}
+
+func newTargetDialer(cfg *ymlCfg) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   cfg.Timeouts.Connect,
+		KeepAlive: 30 * time.Second,
+	}
+}
+
+// newTargetHTTPTransport applies the target's timeouts, connection policy & TLS
+func newTargetHTTPTransport(cfg *ymlCfg, dialer *net.Dialer) *http.Transport {
+	// Same as http.DefaultTransport's but compression, which is left to harRecorder
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: cfg.Timeouts.ResponseHeader,
+		DisableKeepAlives:     cfg.NoKeepAlive,
+		DisableCompression:    true,
+	}
+	if cfg.TLSConfig != nil {
+		transport.TLSClientConfig = cfg.TLSConfig.Clone()
+	}
+	return transport
+}
+
+// h2cTransport talks HTTP/2 over the connections transport would dial
+func h2cTransport(transport *http.Transport) *http2.Transport {
+	dial := transport.DialContext
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dial(context.Background(), network, addr)
+		},
+	}
+}
+
+// isTimeout tells whether a request failed for taking too long
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
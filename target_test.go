@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sebcat/har"
+	"golang.org/x/net/http2"
+)
+
+func TestTargetURL(t *testing.T) {
+	for _, c := range []struct {
+		cfg      ymlCfg
+		expected string
+	}{
+		{ymlCfg{FinalHost: "localhost", FinalPort: "8080"}, "//localhost:8080"},
+		{ymlCfg{FinalHost: "[::1]", FinalPort: "8080"}, "//[::1]:8080"},
+		{ymlCfg{FinalTarget: "https://example.com/api/v1"}, "https://example.com/api/v1"},
+		{ymlCfg{FinalTarget: "http://[::1]:8080/"}, "http://[::1]:8080/"},
+		{ymlCfg{FinalTarget: "unix:///var/run/sut.sock"}, "unix:///var/run/sut.sock"},
+		{ymlCfg{FinalTarget: "ftp://example.com"}, ""},
+		{ymlCfg{FinalTarget: "http:///api"}, ""},
+		{ymlCfg{FinalTarget: "unix://"}, ""},
+		{ymlCfg{FinalTarget: "https://example.com", HTTP2: http2H2C}, ""},
+		{ymlCfg{FinalTarget: "https://example.com", CaptureWire: true}, ""},
+		{ymlCfg{FinalTarget: "https://example.com", CaptureWire: true, HTTP2: http2Auto}, ""},
+		{ymlCfg{FinalTarget: "https://example.com", CaptureWire: true, HTTP2: http2Off}, "https://example.com"},
+		{ymlCfg{FinalTarget: "http://example.com", CaptureWire: true}, "http://example.com"},
+	} {
+		target, err := c.cfg.targetURL()
+		if c.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.cfg.FinalTarget)
+			}
+			continue
+		}
+		if err != nil || target.String() != c.expected {
+			t.Errorf("expected %s, got %v (%v)", c.expected, target, err)
+		}
+	}
+}
+
+func TestFinalizingConfChecksTarget(t *testing.T) {
+	cfg := &ymlCfg{Target: "https://example.com", CaptureWire: true}
+	if err := maybeFinalizeConf(cfg, kindStart); err == nil {
+		t.Error("expected capturing the wire of an HTTP/2 over TLS target to fail")
+	}
+	cfg = &ymlCfg{Target: "https://example.com", CaptureWire: true, HTTP2: http2Off}
+	if err := maybeFinalizeConf(cfg, kindStart); err != nil || cfg.FinalTarget != "https://example.com" {
+		t.Errorf("unexpected target %q (%v)", cfg.FinalTarget, err)
+	}
+
+	// A target templated to nothing falls back to host & port
+	cfg = &ymlCfg{Target: `{{ "" }}`, Host: "localhost", Port: "8080"}
+	if err := maybeFinalizeConf(cfg, kindStart); err != nil || cfg.FinalTarget != "" || cfg.FinalPort != "8080" {
+		t.Errorf("unexpected target %q on port %q (%v)", cfg.FinalTarget, cfg.FinalPort, err)
+	}
+}
+
+func TestUpdateURLPrefixesTargetPath(t *testing.T) {
+	for target, expected := range map[string]string{
+		"//localhost:8080":            "http://localhost:8080/items/a%2Fb?q=1",
+		"https://example.com/api/v1/": "https://example.com/api/v1/items/a%2Fb?q=1",
+		"http://[::1]:8080/api":       "http://[::1]:8080/api/items/a%2Fb?q=1",
+		"unix:///var/run/sut.sock":    "http://" + unixHost + "/items/a%2Fb?q=1",
+	} {
+		targetURL, err := url.Parse(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := &reqCmd{HARRequest: &har.Request{URL: "http://localhost/items/a%2Fb?q=1"}}
+		if err = cmd.updateURL(targetURL); err != nil || cmd.HARRequest.URL != expected {
+			t.Errorf("%s: expected %s, got %s (%v)", target, expected, cmd.HARRequest.URL, err)
+		}
+	}
+}
+
+func TestTargetTransportDialsUnixSockets(t *testing.T) {
+	dir, err := ioutil.TempDir("", binName+"_target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "sut.sock")
+	server := httptest.NewUnstartedServer(http.HandlerFunc(sutOK))
+	server.Listener.Close()
+	if server.Listener, err = net.Listen("unix", socket); err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Close()
+
+	target := &url.URL{Scheme: schemeUnix, Path: socket}
+	client := &http.Client{Transport: targetTransport(&ymlCfg{}, target)}
+	resp, err := client.Get("http://" + unixHost + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %s", resp.Status)
+	}
+}
+
+func TestTargetTLSConfig(t *testing.T) {
+	if tlsConfig, err := (&targetTLSYML{}).config(); err != nil || tlsConfig != nil {
+		t.Errorf("expected the defaults, got %+v (%v)", tlsConfig, err)
+	}
+
+	tlsConfig, err := (&targetTLSYML{ServerName: "example.com", Insecure: true}).config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.ServerName != "example.com" || !tlsConfig.InsecureSkipVerify {
+		t.Errorf("unexpected config %+v", tlsConfig)
+	}
+
+	if _, err = (&targetTLSYML{CAFile: "missing.pem"}).config(); err == nil {
+		t.Error("expected an error for a missing CA file")
+	}
+}
+
+func TestTargetTransportTrust(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(sutOK))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", binName+"_target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeKeyPair(t, dir, server.TLS.Certificates[0])
+
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		tls     targetTLSYML
+		trusted bool
+	}{
+		{targetTLSYML{}, false},
+		{targetTLSYML{Insecure: true}, true},
+		{targetTLSYML{CAFile: filepath.Join(dir, "sut.pem")}, true},
+		{targetTLSYML{CAFile: filepath.Join(dir, "sut.pem"), ServerName: "example.com"}, true},
+		{targetTLSYML{CAFile: filepath.Join(dir, "sut.pem"), ServerName: "example.org"}, false},
+	} {
+		tlsConfig, err := c.tls.config()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: targetTransport(&ymlCfg{TLSConfig: tlsConfig}, target)}
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if trusted := err == nil; trusted != c.trusted {
+			t.Errorf("%+v: expected trusted=%v, got %v", c.tls, c.trusted, err)
+		}
+	}
+}
+
+func TestTargetTimeoutsParse(t *testing.T) {
+	timeouts, err := (&targetTimeoutsYML{}).parse()
+	if err != nil || timeouts != (targetTimeouts{Request: timeoutLong}) {
+		t.Errorf("expected the defaults, got %+v (%v)", timeouts, err)
+	}
+
+	timeouts, err = (&targetTimeoutsYML{Request: "30s", Connect: "5s", ResponseHeader: "1m30s"}).parse()
+	expected := targetTimeouts{Request: 30 * time.Second, Connect: 5 * time.Second, ResponseHeader: 90 * time.Second}
+	if err != nil || timeouts != expected {
+		t.Errorf("expected %+v, got %+v (%v)", expected, timeouts, err)
+	}
+
+	if _, err = (&targetTimeoutsYML{Connect: "5"}).parse(); err == nil {
+		t.Error("expected an error for a duration without unit")
+	}
+}
+
+func TestTargetTransportConnections(t *testing.T) {
+	var conns int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(sutOK))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		cfg      ymlCfg
+		expected int64
+	}{
+		{ymlCfg{}, 1},
+		{ymlCfg{FreshConnections: true}, 3},
+		{ymlCfg{NoKeepAlive: true}, 6},
+	} {
+		atomic.StoreInt64(&conns, 0)
+		cfg := c.cfg
+		// 3 tests of 2 requests each
+		for test := 0; test < 3; test++ {
+			client := &http.Client{Transport: targetTransport(&cfg, target)}
+			for req := 0; req < 2; req++ {
+				resp, err := client.Get(server.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+		}
+		cfg.Transport.CloseIdleConnections()
+		if got := atomic.LoadInt64(&conns); got != c.expected {
+			t.Errorf("%+v: expected %d connections, got %d", c.cfg, c.expected, got)
+		}
+	}
+}
+
+func TestTargetTransportHTTP2(t *testing.T) {
+	var seen int64
+	sut := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt64(&seen, int64(r.ProtoMajor))
+		sutOK(w, r)
+	})
+	// HTTP/2 negotiated through ALPN
+	h2Server := httptest.NewUnstartedServer(sut)
+	h2Server.TLS = &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	if err := http2.ConfigureServer(h2Server.Config, nil); err != nil {
+		t.Fatal(err)
+	}
+	h2Server.StartTLS()
+	defer h2Server.Close()
+	h2cServer := httptest.NewServer(h2cHandler(sut))
+	defer h2cServer.Close()
+
+	for _, c := range []struct {
+		server   *httptest.Server
+		mode     string
+		expected int
+	}{
+		{h2Server, "", 2},
+		{h2Server, http2Auto, 2},
+		{h2Server, http2Off, 1},
+		{h2cServer, http2Auto, 1},
+		{h2cServer, http2H2C, 2},
+	} {
+		target, err := url.Parse(c.server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		atomic.StoreInt64(&seen, 0)
+		cfg := &ymlCfg{HTTP2: c.mode, TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+		client := &http.Client{Transport: targetTransport(cfg, target)}
+		resp, err := client.Get(c.server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := atomic.LoadInt64(&seen); resp.ProtoMajor != c.expected || got != int64(c.expected) {
+			t.Errorf("%s with %q: expected HTTP/%d, got %s and the server saw HTTP/%d",
+				c.server.URL, c.mode, c.expected, resp.Proto, got)
+		}
+	}
+}
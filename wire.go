@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// wireCapture writes the exact bytes sent & received by each request,
+// after TLS decryption, to a file of the run.
+// Connections write & read from the transport's own goroutines.
+type wireCapture struct {
+	sync.Mutex
+	path     string
+	file     *os.File
+	offset   int64
+	sent     bytes.Buffer
+	received bytes.Buffer
+}
+
+// harWire links a HAR entry to its bytes in the wire capture file.
+// The file's path stays in the log: it is of no use upstream.
+type harWire struct {
+	Sent     wireSpan `json:"sent"`
+	Received wireSpan `json:"received"`
+}
+
+type wireSpan struct {
+	Offset int64 `json:"offset"`
+	Size   int   `json:"size"`
+}
+
+// wireConn feeds a wireCapture what goes through it
+type wireConn struct {
+	net.Conn
+	capture *wireCapture
+}
+
+func newWireCapture(path string) (capture *wireCapture, err error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		log.Println("[ERR]", err)
+		fmt.Printf("Could not capture wire to '%s'\n", path)
+		return
+	}
+
+	log.Println("[NFO] capturing wire to", path)
+	capture = &wireCapture{path: path, file: file}
+	return
+}
+
+// capturingDials makes transport dial connections that feed capture.
+// TLS is done here so that what gets captured is what TLS encrypts.
+func (capture *wireCapture) capturingDials(transport *http.Transport) {
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &wireConn{Conn: conn, capture: capture}, nil
+	}
+
+	tlsConfig := transport.TLSClientConfig
+	handshakeTimeout := transport.TLSHandshakeTimeout
+	transport.DialTLS = func(network, addr string) (net.Conn, error) {
+		conn, err := dial(context.Background(), network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		config := &tls.Config{}
+		if tlsConfig != nil {
+			config = tlsConfig.Clone()
+		}
+		// The transport would not know to talk HTTP/2 over a wireConn
+		config.NextProtos = nil
+		if config.ServerName == "" {
+			if config.ServerName, _, err = net.SplitHostPort(addr); err != nil {
+				config.ServerName = addr
+			}
+		}
+
+		tlsConn := tls.Client(conn, config)
+		conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return &wireConn{Conn: tlsConn, capture: capture}, nil
+	}
+}
+
+func (conn *wireConn) Read(p []byte) (n int, err error) {
+	n, err = conn.Conn.Read(p)
+	conn.capture.Lock()
+	conn.capture.received.Write(p[:n])
+	conn.capture.Unlock()
+	return
+}
+
+func (conn *wireConn) Write(p []byte) (n int, err error) {
+	n, err = conn.Conn.Write(p)
+	conn.capture.Lock()
+	conn.capture.sent.Write(p[:n])
+	conn.capture.Unlock()
+	return
+}
+
+// start drops what was captured in between requests
+func (capture *wireCapture) start() {
+	capture.Lock()
+	capture.sent.Reset()
+	capture.received.Reset()
+	capture.Unlock()
+}
+
+// flush writes what was captured since start, labeled
+func (capture *wireCapture) flush(label string) (wire *harWire) {
+	capture.Lock()
+	defer capture.Unlock()
+
+	wire = &harWire{}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "▲ %s: %d bytes sent\n", label, capture.sent.Len())
+	wire.Sent = wireSpan{Offset: capture.offset + int64(buf.Len()), Size: capture.sent.Len()}
+	buf.Write(capture.sent.Bytes())
+	fmt.Fprintf(&buf, "\n▼ %s: %d bytes received\n", label, capture.received.Len())
+	wire.Received = wireSpan{Offset: capture.offset + int64(buf.Len()), Size: capture.received.Len()}
+	buf.Write(capture.received.Bytes())
+	buf.WriteString("\n\n")
+
+	n, err := capture.file.Write(buf.Bytes())
+	capture.offset += int64(n)
+	if err != nil {
+		log.Println("[ERR]", err)
+		return nil
+	}
+	capture.sent.Reset()
+	capture.received.Reset()
+	return
+}
+
+// closeWire ends the run's wire capture, if any
+func closeWire(cfg *ymlCfg) {
+	if cfg.Wire == nil {
+		return
+	}
+	capture := cfg.Wire
+	capture.Lock()
+	defer capture.Unlock()
+	if err := capture.file.Close(); err != nil {
+		log.Println("[ERR]", err)
+	}
+	log.Println("[NFO] captured wire to", capture.path)
+	cfg.Wire = nil
+}
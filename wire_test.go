@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWireCapture(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(sutOK))
+	defer server.Close()
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", binName+"_wire")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldTmp := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", dir)
+	defer os.Setenv("TMPDIR", oldTmp)
+	if err = makePwdID(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { clientReq, harCollector = nil, nil }()
+
+	cfg := &ymlCfg{CaptureWire: true, HTTP2: http2Off, TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	newHARTransport(cfg, target)
+	for i := 0; i < 2; i++ {
+		resp, err := clientReq.Get(server.URL + "/items")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = readBody(resp, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	capture := cfg.Wire
+	closeWire(cfg)
+	if cfg.Wire != nil {
+		t.Error("expected the capture to be done with")
+	}
+	if _, err = capture.file.Write([]byte("more")); err == nil {
+		t.Error("expected the capture file to be closed")
+	}
+
+	wire, err := ioutil.ReadFile(wireID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range harCollector.entries {
+		if entry.Wire == nil {
+			t.Fatal("expected the entry to point at the capture")
+		}
+		if reported, _ := json.Marshal(entry); bytes.Contains(reported, []byte(dir)) {
+			t.Errorf("expected the capture's path to stay local, got %s", reported)
+		}
+		sent := entry.Wire.Sent
+		if request := string(wire[sent.Offset : sent.Offset+int64(sent.Size)]); !strings.HasPrefix(request,
+			"GET /items HTTP/1.1\r\nHost: "+target.Host+"\r\n") {
+			t.Errorf("unexpected request %q", request)
+		}
+		received := entry.Wire.Received
+		if response := string(wire[received.Offset : received.Offset+int64(received.Size)]); !strings.HasPrefix(response,
+			"HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(response, `{"ok": true}`+"\n") {
+			t.Errorf("unexpected response %q", response)
+		}
+	}
+}